@@ -0,0 +1,130 @@
+package main
+
+import "math/bits"
+
+// allowList restricts which nodes can be part of a search result. Nodes which
+// are not allowed are still traversed, so that the graph stays navigable even
+// with very restrictive filters. A nil allowList allows every node.
+type allowList interface {
+	contains(id int) bool
+	len() int
+}
+
+// idSetAllowList is a good fit for small lists of allowed IDs
+type idSetAllowList map[int]struct{}
+
+func newIDSetAllowList(ids ...int) idSetAllowList {
+	out := make(idSetAllowList, len(ids))
+	for _, id := range ids {
+		out[id] = struct{}{}
+	}
+
+	return out
+}
+
+func (l idSetAllowList) contains(id int) bool {
+	_, ok := l[id]
+	return ok
+}
+
+func (l idSetAllowList) len() int {
+	return len(l)
+}
+
+// bitmapAllowList uses a single bit per node, which is more compact than a set
+// once a large share of the nodes is allowed
+type bitmapAllowList struct {
+	bits  []uint64
+	count int
+}
+
+func newBitmapAllowList(ids ...int) *bitmapAllowList {
+	out := &bitmapAllowList{}
+	for _, id := range ids {
+		out.add(id)
+	}
+
+	return out
+}
+
+func (b *bitmapAllowList) add(id int) {
+	word := id / 64
+	if word >= len(b.bits) {
+		grown := make([]uint64, word+1)
+		copy(grown, b.bits)
+		b.bits = grown
+	}
+
+	mask := uint64(1) << uint(id%64)
+	if b.bits[word]&mask == 0 {
+		b.bits[word] |= mask
+		b.count++
+	}
+}
+
+func (b *bitmapAllowList) contains(id int) bool {
+	word := id / 64
+	if id < 0 || word >= len(b.bits) {
+		return false
+	}
+
+	return b.bits[word]&(uint64(1)<<uint(id%64)) != 0
+}
+
+func (b *bitmapAllowList) len() int {
+	return b.count
+}
+
+// intersect returns the ids contained in both lists
+func (b *bitmapAllowList) intersect(other *bitmapAllowList) *bitmapAllowList {
+	out := &bitmapAllowList{bits: make([]uint64, min(len(b.bits), len(other.bits)))}
+	for i := range out.bits {
+		out.bits[i] = b.bits[i] & other.bits[i]
+	}
+	out.recount()
+
+	return out
+}
+
+// union returns the ids contained in either list
+func (b *bitmapAllowList) union(other *bitmapAllowList) *bitmapAllowList {
+	longer, shorter := b.bits, other.bits
+	if len(shorter) > len(longer) {
+		longer, shorter = shorter, longer
+	}
+
+	out := &bitmapAllowList{bits: make([]uint64, len(longer))}
+	copy(out.bits, longer)
+	for i := range shorter {
+		out.bits[i] |= shorter[i]
+	}
+	out.recount()
+
+	return out
+}
+
+// complement returns the ids in 0..size-1 which are not in the list
+func (b *bitmapAllowList) complement(size int) *bitmapAllowList {
+	out := &bitmapAllowList{bits: make([]uint64, (size+63)/64)}
+	for i := range out.bits {
+		if i < len(b.bits) {
+			out.bits[i] = ^b.bits[i]
+		} else {
+			out.bits[i] = ^uint64(0)
+		}
+	}
+
+	if rest := size % 64; rest != 0 {
+		out.bits[len(out.bits)-1] &= uint64(1)<<uint(rest) - 1
+	}
+	out.recount()
+
+	return out
+}
+
+func (b *bitmapAllowList) recount() {
+	b.count = 0
+	for _, word := range b.bits {
+		b.count += bits.OnesCount64(word)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+)
+
+// binaryQuantizer keeps a single bit per dimension, which is set if the value
+// is positive. The distance between two codes is the number of differing
+// bits, which approximates the angle between the vectors and is computed with
+// a popcount per 64 dimensions. A 600-dim vector takes 80 bytes instead of
+// 2400. It needs no training, but it only works well for embeddings whose
+// dimensions are centered around zero. Since the distances are coarse and
+// tie frequently, the candidates are oversampled before they are rescored
+// with the full vectors.
+type binaryQuantizer struct {
+	dimensions int
+	factor     int
+	codes      *codeStore
+}
+
+func newBinaryQuantizer(dimensions, oversampling int) (*binaryQuantizer, error) {
+	if dimensions < 1 {
+		return nil, fmt.Errorf("binary quantizer needs at least one dimension, got %d", dimensions)
+	}
+
+	if oversampling < 1 {
+		return nil, fmt.Errorf("oversampling must be at least 1, got %d", oversampling)
+	}
+
+	words := (dimensions + 63) / 64
+	return &binaryQuantizer{
+		dimensions: dimensions,
+		factor:     oversampling,
+		codes:      newCodeStore(words * 8),
+	}, nil
+}
+
+func (bq *binaryQuantizer) withoutCodes() *binaryQuantizer {
+	return &binaryQuantizer{
+		dimensions: bq.dimensions,
+		factor:     bq.factor,
+		codes:      newCodeStore(bq.codes.codeLength),
+	}
+}
+
+// quantize packs the sign bits into little endian 64 bit words
+func (bq *binaryQuantizer) quantize(vector []float32) []byte {
+	if len(vector) != bq.dimensions {
+		panic(fmt.Sprintf("binary quantizer expects %d dimensions, got %d",
+			bq.dimensions, len(vector)))
+	}
+
+	code := make([]byte, bq.codes.codeLength)
+	for d, value := range vector {
+		if value > 0 {
+			code[d/8] |= 1 << uint(d%8)
+		}
+	}
+
+	return code
+}
+
+func (bq *binaryQuantizer) encode(id int, vector []float32) {
+	bq.codes.set(id, bq.quantize(vector))
+}
+
+func (bq *binaryQuantizer) delete(id int) {
+	bq.codes.delete(id)
+}
+
+func (bq *binaryQuantizer) oversampling() int {
+	return bq.factor
+}
+
+func (bq *binaryQuantizer) queryDistancer(query []float32) distanceToQuery {
+	queryCode := bq.quantize(query)
+
+	return func(id int) float32 {
+		code := bq.codes.get(id)
+		if code == nil {
+			return maxDistance
+		}
+
+		return float32(hammingBits(queryCode, code))
+	}
+}
+
+func (bq *binaryQuantizer) distanceBetween(a, b int) float32 {
+	codeA, codeB := bq.codes.get(a), bq.codes.get(b)
+	if codeA == nil || codeB == nil {
+		return maxDistance
+	}
+
+	return float32(hammingBits(codeA, codeB))
+}
+
+// hammingBits counts the differing bits, both codes must have the same length
+// which is a multiple of 8 bytes
+func hammingBits(a, b []byte) int {
+	b = b[:len(a)]
+
+	count := 0
+	for i := 0; i+8 <= len(a); i += 8 {
+		count += bits.OnesCount64(binary.LittleEndian.Uint64(a[i:]) ^ binary.LittleEndian.Uint64(b[i:]))
+	}
+
+	return count
+}
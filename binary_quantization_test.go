@@ -0,0 +1,85 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestBinaryQuantizer(t *testing.T) {
+	t.Run("hamming distance", func(t *testing.T) {
+		bq, err := newBinaryQuantizer(70, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		a := make([]float32, 70)
+		b := make([]float32, 70)
+		for d := range a {
+			a[d], b[d] = 1, 1
+		}
+		b[0], b[63], b[64], b[69] = -1, -1, 0, -0.5
+		bq.encode(0, a)
+		bq.encode(1, b)
+
+		if len(bq.codes.get(0)) != 16 {
+			t.Errorf("expected 70 dimensions to take two words, got %d bytes", len(bq.codes.get(0)))
+		}
+
+		if dist := bq.distanceBetween(0, 1); dist != 4 {
+			t.Errorf("expected distance 4, got %f", dist)
+		}
+
+		if dist := bq.queryDistancer(a)(1); dist != 4 {
+			t.Errorf("expected query distance 4, got %f", dist)
+		}
+
+		bq.delete(1)
+		if dist := bq.distanceBetween(0, 1); dist != maxDistance {
+			t.Errorf("expected deleted code to be infinitely far away, got %f", dist)
+		}
+	})
+
+	t.Run("invalid settings", func(t *testing.T) {
+		if _, err := newBinaryQuantizer(0, 1); err == nil {
+			t.Error("expected an error for zero dimensions")
+		}
+
+		if _, err := newBinaryQuantizer(10, 0); err == nil {
+			t.Error("expected an error for zero oversampling")
+		}
+	})
+
+	t.Run("recall with oversampling", func(t *testing.T) {
+		r := rand.New(rand.NewSource(7))
+		vectors := randomVectors(r, 1000, vectorDimensions)
+
+		cfg := testConfig()
+		cfg.maximumConnections = 16
+		cfg.distancer = cosineDistancer{}
+		h := buildTestGraph(t, vectors, cfg)
+
+		queries := h.sampleQueries(r, 50)
+		recall := func(oversampling int) float64 {
+			bq, err := newBinaryQuantizer(vectorDimensions, oversampling)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h.compress(bq)
+
+			return h.evaluate(queries, 10, []int{10}).Results[0].Recall
+		}
+
+		without, with := recall(1), recall(10)
+		t.Logf("recall@10 without oversampling %f, with 10x oversampling %f", without, with)
+		// uniformly random vectors are the worst case for a single bit, real
+		// embeddings do a lot better
+		if with < without+0.2 {
+			t.Errorf("expected oversampling to improve recall, got %f with and %f without",
+				with, without)
+		}
+
+		if with < 0.8 {
+			t.Errorf("expected recall of at least 0.8 with oversampling, got %f", with)
+		}
+	})
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+)
+
+// vectorCompressor keeps a compact, lossy copy of every vector in memory, so
+// that the graph can be traversed without reading the full vectors from the
+// store. Only the final candidates of a search are rescored with the full
+// vectors. Implementations must be safe for concurrent use. They also provide
+// withoutCodes, which returns a copy with the same training but no encoded
+// vectors, so that the training can be shared between graphs.
+type vectorCompressor interface {
+	// encode stores the compressed form of the vector under id, replacing a
+	// previous one
+	encode(id int, vector []float32)
+
+	delete(id int)
+
+	// queryDistancer returns the approximate distance between the query and
+	// the compressed vector of a node. Nodes which were never encoded have
+	// the maximum distance.
+	queryDistancer(query []float32) distanceToQuery
+
+	// distanceBetween is the approximate distance between two compressed
+	// vectors, used while building the graph
+	distanceBetween(a, b int) float32
+
+	// oversampling is the factor by which the number of candidates is
+	// multiplied before they are rescored, coarse approximations need more
+	// candidates to contain the true nearest neighbors. It is 1 if ef alone
+	// provides enough candidates.
+	oversampling() int
+}
+
+// compress encodes every vector of the graph with c and uses the compressed
+// vectors from then on, new vectors are encoded on insert. The compressed
+// vectors are not part of the index file, so a loaded graph has to be
+// compressed again. It must not run concurrently with inserts.
+func (h *hnsw) compress(c vectorCompressor) {
+	h.RLock()
+	nodes := h.nodes.snapshot()
+	h.RUnlock()
+
+	nodes.forEach(func(node *hnswVertex) {
+		c.encode(node.id, h.vectorForID(node.id))
+	})
+
+	h.Lock()
+	h.compressor = c
+	h.Unlock()
+}
+
+// rescore replaces the approximate distances of a compressed search with the
+// exact ones and restores the order, so the caller can cut off the best k
+func (h *hnsw) rescore(queryVector []float32, candidates []priorityQueueItem) []priorityQueueItem {
+	out := make([]priorityQueueItem, len(candidates))
+	for i, candidate := range candidates {
+		out[i] = priorityQueueItem{id: candidate.id, dist: h.distToVector(candidate.id, queryVector)}
+	}
+
+	sortByDistance(out)
+	return out
+}
+
+// segmentDistancer splits a metric into a sum over parts of the vectors: the
+// distance of the whole vectors is offset plus the sum of partial over all
+// parts. This allows compressors to precompute the distances per part.
+type segmentDistancer struct {
+	partial func(a, b []float32) float32
+	offset  float32
+}
+
+func newSegmentDistancer(metric distanceMetric) (segmentDistancer, error) {
+	negativeDot := func(a, b []float32) float32 { return -dotProductImpl(a, b) }
+
+	switch metric {
+	case metricCosine:
+		// 1 - dot, vectors are normalized before they are encoded
+		return segmentDistancer{partial: negativeDot, offset: 1}, nil
+	case metricDotProduct:
+		return segmentDistancer{partial: negativeDot}, nil
+	case metricSquaredL2:
+		return segmentDistancer{partial: squaredL2Impl}, nil
+	case metricManhattan:
+		return segmentDistancer{partial: manhattanImpl}, nil
+	case metricHamming:
+		return segmentDistancer{partial: hammingImpl}, nil
+	default:
+		return segmentDistancer{}, fmt.Errorf("unsupported distance metric %d", metric)
+	}
+}
+
+// prepareForCompression normalizes vectors for cosine, so that the distance
+// can be split into a sum of partial dot products
+func prepareForCompression(metric distanceMetric, vector []float32) []float32 {
+	if metric == metricCosine {
+		return normalizeVector(vector)
+	}
+
+	return vector
+}
+
+// codesChunkSize is the number of codes allocated at once
+const codesChunkSize = 1 << 14
+
+// codeStore holds fixed-length codes indexed by id. Like hnswNodes it grows
+// in chunks, but all codes of a chunk share a single allocation, which keeps
+// the overhead per vector at a single bit.
+type codeStore struct {
+	sync.RWMutex
+	codeLength int
+	chunks     [][]byte
+	present    [][]uint64
+}
+
+func newCodeStore(codeLength int) *codeStore {
+	return &codeStore{codeLength: codeLength}
+}
+
+func (s *codeStore) set(id int, code []byte) {
+	s.Lock()
+	defer s.Unlock()
+
+	chunk, pos := id/codesChunkSize, id%codesChunkSize
+	for chunk >= len(s.chunks) {
+		s.chunks = append(s.chunks, make([]byte, codesChunkSize*s.codeLength))
+		s.present = append(s.present, make([]uint64, codesChunkSize/64))
+	}
+
+	copy(s.chunks[chunk][pos*s.codeLength:(pos+1)*s.codeLength], code)
+	s.present[chunk][pos/64] |= 1 << uint(pos%64)
+}
+
+// get returns nil if there is no code for id. The returned code must not be
+// modified, it is only stable as long as id is not encoded again.
+func (s *codeStore) get(id int) []byte {
+	s.RLock()
+	defer s.RUnlock()
+
+	chunk, pos := id/codesChunkSize, id%codesChunkSize
+	if id < 0 || chunk >= len(s.chunks) || s.present[chunk][pos/64]&(1<<uint(pos%64)) == 0 {
+		return nil
+	}
+
+	return s.chunks[chunk][pos*s.codeLength : (pos+1)*s.codeLength : (pos+1)*s.codeLength]
+}
+
+func (s *codeStore) delete(id int) {
+	s.Lock()
+	defer s.Unlock()
+
+	chunk, pos := id/codesChunkSize, id%codesChunkSize
+	if chunk < len(s.chunks) {
+		s.present[chunk][pos/64] &^= 1 << uint(pos%64)
+	}
+}
+
+// maxDistance is used for nodes without a code, so they are never preferred
+const maxDistance = float32(math.MaxFloat32)
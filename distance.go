@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+type distanceMetric uint8 // persisted as part of the index, so only ever append
+
+const (
+	metricCosine distanceMetric = iota
+	metricDotProduct
+	metricSquaredL2
+	metricManhattan
+	metricHamming
+)
+
+func (d distanceMetric) String() string {
+	switch d {
+	case metricCosine:
+		return "cosine"
+	case metricDotProduct:
+		return "dot"
+	case metricSquaredL2:
+		return "l2-squared"
+	case metricManhattan:
+		return "manhattan"
+	case metricHamming:
+		return "hamming"
+	default:
+		return fmt.Sprintf("unknown metric %d", d)
+	}
+}
+
+func parseDistanceMetric(name string) (distanceMetric, error) {
+	for _, metric := range []distanceMetric{metricCosine, metricDotProduct,
+		metricSquaredL2, metricManhattan, metricHamming} {
+		if metric.String() == name {
+			return metric, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unsupported distance metric %q", name)
+}
+
+// distanceProvider calculates the distance between two vectors, the smaller
+// the distance, the more similar the vectors are
+type distanceProvider interface {
+	distance(a, b []float32) float32
+	metric() distanceMetric
+}
+
+func newDistanceProvider(metric distanceMetric) (distanceProvider, error) {
+	switch metric {
+	case metricCosine:
+		return cosineDistancer{}, nil
+	case metricDotProduct:
+		return dotProductDistancer{}, nil
+	case metricSquaredL2:
+		return squaredL2Distancer{}, nil
+	case metricManhattan:
+		return manhattanDistancer{}, nil
+	case metricHamming:
+		return hammingDistancer{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported distance metric %d", metric)
+	}
+}
+
+type cosineDistancer struct{}
+
+func (cosineDistancer) distance(a, b []float32) float32 {
+	return cosineDist(a, b)
+}
+
+func (cosineDistancer) metric() distanceMetric {
+	return metricCosine
+}
+
+// normalizedCosineDistancer is the fast path for cosine distance. It expects
+// both vectors to have unit length, in which case the cosine similarity is
+// just their dot product and the norms don't have to be recomputed on every
+// call. Vectors from a normalizing cache and queries passed through
+// normalizeVector qualify.
+type normalizedCosineDistancer struct{}
+
+func (normalizedCosineDistancer) distance(a, b []float32) float32 {
+	if flagMonitorDistancing {
+		defer m.addDistancing(time.Now())
+	}
+	mustHaveSameDimensions(a, b)
+
+	return 1 - dotProductImpl(a, b)
+}
+
+func (normalizedCosineDistancer) metric() distanceMetric {
+	return metricCosine
+}
+
+// normalizeVector returns a copy of v with unit length, the input is never
+// modified. A zero vector has no direction and is returned as is.
+func normalizeVector(v []float32) []float32 {
+	var sum float64
+	for _, elem := range v {
+		sum += float64(elem * elem)
+	}
+
+	out := make([]float32, len(v))
+	if sum == 0 {
+		copy(out, v)
+		return out
+	}
+
+	norm := float32(math.Sqrt(sum))
+	for i, elem := range v {
+		out[i] = elem / norm
+	}
+
+	return out
+}
+
+// dotProductDistancer uses the negative dot product, so that larger products
+// lead to smaller distances
+type dotProductDistancer struct{}
+
+func (dotProductDistancer) distance(a, b []float32) float32 {
+	if flagMonitorDistancing {
+		defer m.addDistancing(time.Now())
+	}
+	mustHaveSameDimensions(a, b)
+
+	return -dotProductImpl(a, b)
+}
+
+func (dotProductDistancer) metric() distanceMetric {
+	return metricDotProduct
+}
+
+// squaredL2Distancer skips the square root, as it does not change the order
+// of the results
+type squaredL2Distancer struct{}
+
+func (squaredL2Distancer) distance(a, b []float32) float32 {
+	if flagMonitorDistancing {
+		defer m.addDistancing(time.Now())
+	}
+	mustHaveSameDimensions(a, b)
+
+	return squaredL2Impl(a, b)
+}
+
+func (squaredL2Distancer) metric() distanceMetric {
+	return metricSquaredL2
+}
+
+type manhattanDistancer struct{}
+
+func (manhattanDistancer) distance(a, b []float32) float32 {
+	if flagMonitorDistancing {
+		defer m.addDistancing(time.Now())
+	}
+	mustHaveSameDimensions(a, b)
+
+	return manhattanImpl(a, b)
+}
+
+func (manhattanDistancer) metric() distanceMetric {
+	return metricManhattan
+}
+
+// hammingDistancer counts the dimensions in which the vectors differ
+type hammingDistancer struct{}
+
+func (hammingDistancer) distance(a, b []float32) float32 {
+	if flagMonitorDistancing {
+		defer m.addDistancing(time.Now())
+	}
+	mustHaveSameDimensions(a, b)
+
+	return hammingImpl(a, b)
+}
+
+func (hammingDistancer) metric() distanceMetric {
+	return metricHamming
+}
+
+func mustHaveSameDimensions(a, b []float32) {
+	if len(a) != len(b) {
+		panic(fmt.Sprintf("vectors have different dimensions: %d vs %d", len(a), len(b)))
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import "math"
+
+// The kernels below are the inner loops of all distancers. They expect both
+// vectors to have the same length, which the distancers make sure of. The
+// portable versions are unrolled with independent accumulators, so that the
+// additions don't have to wait for each other. On CPUs with AVX2 and FMA they
+// are replaced with assembly versions at startup, see
+// distance_kernels_amd64.go.
+var (
+	dotProductImpl = dotProductGo
+	squaredL2Impl  = squaredL2Go
+	manhattanImpl  = manhattanGo
+	hammingImpl    = hammingGo
+)
+
+// distanceKernels names the implementation in use, for the startup log
+var distanceKernels = "go"
+
+func dotProductGo(a, b []float32) float32 {
+	b = b[:len(a)]
+
+	var s0, s1, s2, s3 float32
+	i := 0
+	for ; i+4 <= len(a); i += 4 {
+		x, y := a[i:i+4:i+4], b[i:i+4:i+4]
+		s0 += x[0] * y[0]
+		s1 += x[1] * y[1]
+		s2 += x[2] * y[2]
+		s3 += x[3] * y[3]
+	}
+
+	for ; i < len(a); i++ {
+		s0 += a[i] * b[i]
+	}
+
+	return s0 + s1 + s2 + s3
+}
+
+func squaredL2Go(a, b []float32) float32 {
+	b = b[:len(a)]
+
+	var s0, s1, s2, s3 float32
+	i := 0
+	for ; i+4 <= len(a); i += 4 {
+		x, y := a[i:i+4:i+4], b[i:i+4:i+4]
+		d0, d1, d2, d3 := x[0]-y[0], x[1]-y[1], x[2]-y[2], x[3]-y[3]
+		s0 += d0 * d0
+		s1 += d1 * d1
+		s2 += d2 * d2
+		s3 += d3 * d3
+	}
+
+	for ; i < len(a); i++ {
+		d := a[i] - b[i]
+		s0 += d * d
+	}
+
+	return s0 + s1 + s2 + s3
+}
+
+func manhattanGo(a, b []float32) float32 {
+	b = b[:len(a)]
+
+	var s0, s1, s2, s3 float32
+	i := 0
+	for ; i+4 <= len(a); i += 4 {
+		x, y := a[i:i+4:i+4], b[i:i+4:i+4]
+		s0 += abs32(x[0] - y[0])
+		s1 += abs32(x[1] - y[1])
+		s2 += abs32(x[2] - y[2])
+		s3 += abs32(x[3] - y[3])
+	}
+
+	for ; i < len(a); i++ {
+		s0 += abs32(a[i] - b[i])
+	}
+
+	return s0 + s1 + s2 + s3
+}
+
+func hammingGo(a, b []float32) float32 {
+	b = b[:len(a)]
+
+	var s0, s1, s2, s3 int
+	i := 0
+	for ; i+4 <= len(a); i += 4 {
+		x, y := a[i:i+4:i+4], b[i:i+4:i+4]
+		if x[0] != y[0] {
+			s0++
+		}
+		if x[1] != y[1] {
+			s1++
+		}
+		if x[2] != y[2] {
+			s2++
+		}
+		if x[3] != y[3] {
+			s3++
+		}
+	}
+
+	for ; i < len(a); i++ {
+		if a[i] != b[i] {
+			s0++
+		}
+	}
+
+	return float32(s0 + s1 + s2 + s3)
+}
+
+// abs32 clears the sign bit instead of taking the detour through float64
+func abs32(f float32) float32 {
+	return math.Float32frombits(math.Float32bits(f) &^ (1 << 31))
+}
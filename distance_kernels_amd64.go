@@ -0,0 +1,55 @@
+package main
+
+func init() {
+	if hasAVX2AndFMA() {
+		dotProductImpl = dotProductAVX2
+		squaredL2Impl = squaredL2AVX2
+		manhattanImpl = manhattanAVX2
+		hammingImpl = hammingAVX2
+		distanceKernels = "avx2+fma"
+	}
+}
+
+// implemented in distance_kernels_amd64.s
+
+//go:noescape
+func dotProductAVX2(a, b []float32) float32
+
+//go:noescape
+func squaredL2AVX2(a, b []float32) float32
+
+//go:noescape
+func manhattanAVX2(a, b []float32) float32
+
+//go:noescape
+func hammingAVX2(a, b []float32) float32
+
+func cpuid(eaxArg, ecxArg uint32) (eax, ebx, ecx, edx uint32)
+
+func xgetbv() (eax, edx uint32)
+
+// hasAVX2AndFMA checks that both the CPU and the operating system support the
+// instructions and the 256 bit registers used by the assembly kernels
+func hasAVX2AndFMA() bool {
+	maxLeaf, _, _, _ := cpuid(0, 0)
+	if maxLeaf < 7 {
+		return false
+	}
+
+	_, _, ecx1, _ := cpuid(1, 0)
+	fma := ecx1&(1<<12) != 0
+	osxsave := ecx1&(1<<27) != 0
+	avx := ecx1&(1<<28) != 0
+	if !fma || !osxsave || !avx {
+		return false
+	}
+
+	// the OS must save and restore the XMM and YMM registers on context switches
+	xcr0, _ := xgetbv()
+	if xcr0&6 != 6 {
+		return false
+	}
+
+	_, ebx7, _, _ := cpuid(7, 0)
+	return ebx7&(1<<5) != 0
+}
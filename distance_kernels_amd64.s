@@ -0,0 +1,306 @@
+#include "textflag.h"
+
+// func dotProductAVX2(a, b []float32) float32
+TEXT ·dotProductAVX2(SB), NOSPLIT, $0-52
+	MOVQ a_base+0(FP), SI
+	MOVQ a_len+8(FP), CX
+	MOVQ b_base+24(FP), DI
+
+	VXORPS Y0, Y0, Y0
+	VXORPS Y1, Y1, Y1
+	VXORPS Y2, Y2, Y2
+	VXORPS Y3, Y3, Y3
+
+	// 32 floats per iteration on four independent accumulators
+dotLoop32:
+	CMPQ CX, $32
+	JL   dotLoop8
+	VMOVUPS     (SI), Y4
+	VMOVUPS     32(SI), Y5
+	VMOVUPS     64(SI), Y6
+	VMOVUPS     96(SI), Y7
+	VFMADD231PS (DI), Y4, Y0
+	VFMADD231PS 32(DI), Y5, Y1
+	VFMADD231PS 64(DI), Y6, Y2
+	VFMADD231PS 96(DI), Y7, Y3
+	ADDQ        $128, SI
+	ADDQ        $128, DI
+	SUBQ        $32, CX
+	JMP         dotLoop32
+
+dotLoop8:
+	CMPQ        CX, $8
+	JL          dotReduce
+	VMOVUPS     (SI), Y4
+	VFMADD231PS (DI), Y4, Y0
+	ADDQ        $32, SI
+	ADDQ        $32, DI
+	SUBQ        $8, CX
+	JMP         dotLoop8
+
+dotReduce:
+	VADDPS       Y1, Y0, Y0
+	VADDPS       Y3, Y2, Y2
+	VADDPS       Y2, Y0, Y0
+	VEXTRACTF128 $1, Y0, X1
+	VADDPS       X1, X0, X0
+	VHADDPS      X0, X0, X0
+	VHADDPS      X0, X0, X0
+
+dotTail:
+	CMPQ        CX, $0
+	JE          dotDone
+	VMOVSS      (SI), X1
+	VFMADD231SS (DI), X1, X0
+	ADDQ        $4, SI
+	ADDQ        $4, DI
+	DECQ        CX
+	JMP         dotTail
+
+dotDone:
+	VZEROUPPER
+	MOVSS X0, ret+48(FP)
+	RET
+
+// func squaredL2AVX2(a, b []float32) float32
+TEXT ·squaredL2AVX2(SB), NOSPLIT, $0-52
+	MOVQ a_base+0(FP), SI
+	MOVQ a_len+8(FP), CX
+	MOVQ b_base+24(FP), DI
+
+	VXORPS Y0, Y0, Y0
+	VXORPS Y1, Y1, Y1
+	VXORPS Y2, Y2, Y2
+	VXORPS Y3, Y3, Y3
+
+l2Loop32:
+	CMPQ        CX, $32
+	JL          l2Loop8
+	VMOVUPS     (SI), Y4
+	VMOVUPS     32(SI), Y5
+	VMOVUPS     64(SI), Y6
+	VMOVUPS     96(SI), Y7
+	VSUBPS      (DI), Y4, Y4
+	VSUBPS      32(DI), Y5, Y5
+	VSUBPS      64(DI), Y6, Y6
+	VSUBPS      96(DI), Y7, Y7
+	VFMADD231PS Y4, Y4, Y0
+	VFMADD231PS Y5, Y5, Y1
+	VFMADD231PS Y6, Y6, Y2
+	VFMADD231PS Y7, Y7, Y3
+	ADDQ        $128, SI
+	ADDQ        $128, DI
+	SUBQ        $32, CX
+	JMP         l2Loop32
+
+l2Loop8:
+	CMPQ        CX, $8
+	JL          l2Reduce
+	VMOVUPS     (SI), Y4
+	VSUBPS      (DI), Y4, Y4
+	VFMADD231PS Y4, Y4, Y0
+	ADDQ        $32, SI
+	ADDQ        $32, DI
+	SUBQ        $8, CX
+	JMP         l2Loop8
+
+l2Reduce:
+	VADDPS       Y1, Y0, Y0
+	VADDPS       Y3, Y2, Y2
+	VADDPS       Y2, Y0, Y0
+	VEXTRACTF128 $1, Y0, X1
+	VADDPS       X1, X0, X0
+	VHADDPS      X0, X0, X0
+	VHADDPS      X0, X0, X0
+
+l2Tail:
+	CMPQ        CX, $0
+	JE          l2Done
+	VMOVSS      (SI), X1
+	VSUBSS      (DI), X1, X1
+	VFMADD231SS X1, X1, X0
+	ADDQ        $4, SI
+	ADDQ        $4, DI
+	DECQ        CX
+	JMP         l2Tail
+
+l2Done:
+	VZEROUPPER
+	MOVSS X0, ret+48(FP)
+	RET
+
+// func manhattanAVX2(a, b []float32) float32
+TEXT ·manhattanAVX2(SB), NOSPLIT, $0-52
+	MOVQ a_base+0(FP), SI
+	MOVQ a_len+8(FP), CX
+	MOVQ b_base+24(FP), DI
+
+	VXORPS Y0, Y0, Y0
+	VXORPS Y1, Y1, Y1
+	VXORPS Y2, Y2, Y2
+	VXORPS Y3, Y3, Y3
+
+	// 0x7fffffff in every lane, and-ing with it clears the sign bit
+	VPCMPEQD Y8, Y8, Y8
+	VPSRLD   $1, Y8, Y8
+
+manhattanLoop32:
+	CMPQ    CX, $32
+	JL      manhattanLoop8
+	VMOVUPS (SI), Y4
+	VMOVUPS 32(SI), Y5
+	VMOVUPS 64(SI), Y6
+	VMOVUPS 96(SI), Y7
+	VSUBPS  (DI), Y4, Y4
+	VSUBPS  32(DI), Y5, Y5
+	VSUBPS  64(DI), Y6, Y6
+	VSUBPS  96(DI), Y7, Y7
+	VANDPS  Y8, Y4, Y4
+	VANDPS  Y8, Y5, Y5
+	VANDPS  Y8, Y6, Y6
+	VANDPS  Y8, Y7, Y7
+	VADDPS  Y4, Y0, Y0
+	VADDPS  Y5, Y1, Y1
+	VADDPS  Y6, Y2, Y2
+	VADDPS  Y7, Y3, Y3
+	ADDQ    $128, SI
+	ADDQ    $128, DI
+	SUBQ    $32, CX
+	JMP     manhattanLoop32
+
+manhattanLoop8:
+	CMPQ    CX, $8
+	JL      manhattanReduce
+	VMOVUPS (SI), Y4
+	VSUBPS  (DI), Y4, Y4
+	VANDPS  Y8, Y4, Y4
+	VADDPS  Y4, Y0, Y0
+	ADDQ    $32, SI
+	ADDQ    $32, DI
+	SUBQ    $8, CX
+	JMP     manhattanLoop8
+
+manhattanReduce:
+	VADDPS       Y1, Y0, Y0
+	VADDPS       Y3, Y2, Y2
+	VADDPS       Y2, Y0, Y0
+	VEXTRACTF128 $1, Y0, X1
+	VADDPS       X1, X0, X0
+	VHADDPS      X0, X0, X0
+	VHADDPS      X0, X0, X0
+
+manhattanTail:
+	CMPQ   CX, $0
+	JE     manhattanDone
+	VMOVSS (SI), X1
+	VSUBSS (DI), X1, X1
+	VANDPS X8, X1, X1
+	VADDSS X1, X0, X0
+	ADDQ   $4, SI
+	ADDQ   $4, DI
+	DECQ   CX
+	JMP    manhattanTail
+
+manhattanDone:
+	VZEROUPPER
+	MOVSS X0, ret+48(FP)
+	RET
+
+// func hammingAVX2(a, b []float32) float32
+TEXT ·hammingAVX2(SB), NOSPLIT, $0-52
+	MOVQ a_base+0(FP), SI
+	MOVQ a_len+8(FP), CX
+	MOVQ b_base+24(FP), DI
+
+	// int32 counters per lane. A differing lane compares to -1, so
+	// subtracting the comparison counts it.
+	VPXOR Y0, Y0, Y0
+	VPXOR Y1, Y1, Y1
+	VPXOR Y2, Y2, Y2
+	VPXOR Y3, Y3, Y3
+
+hammingLoop32:
+	CMPQ    CX, $32
+	JL      hammingLoop8
+	VMOVUPS (SI), Y4
+	VMOVUPS 32(SI), Y5
+	VMOVUPS 64(SI), Y6
+	VMOVUPS 96(SI), Y7
+
+	// predicate 4 is "not equal or unordered", just like != in Go
+	VCMPPS $4, (DI), Y4, Y4
+	VCMPPS $4, 32(DI), Y5, Y5
+	VCMPPS $4, 64(DI), Y6, Y6
+	VCMPPS $4, 96(DI), Y7, Y7
+	VPSUBD Y4, Y0, Y0
+	VPSUBD Y5, Y1, Y1
+	VPSUBD Y6, Y2, Y2
+	VPSUBD Y7, Y3, Y3
+	ADDQ   $128, SI
+	ADDQ   $128, DI
+	SUBQ   $32, CX
+	JMP    hammingLoop32
+
+hammingLoop8:
+	CMPQ    CX, $8
+	JL      hammingReduce
+	VMOVUPS (SI), Y4
+	VCMPPS  $4, (DI), Y4, Y4
+	VPSUBD  Y4, Y0, Y0
+	ADDQ    $32, SI
+	ADDQ    $32, DI
+	SUBQ    $8, CX
+	JMP     hammingLoop8
+
+hammingReduce:
+	VPADDD       Y1, Y0, Y0
+	VPADDD       Y3, Y2, Y2
+	VPADDD       Y2, Y0, Y0
+	VEXTRACTI128 $1, Y0, X1
+	VPADDD       X1, X0, X0
+	VPHADDD      X0, X0, X0
+	VPHADDD      X0, X0, X0
+	VMOVD        X0, AX
+
+hammingTail:
+	CMPQ     CX, $0
+	JE       hammingDone
+	VMOVSS   (SI), X1
+	VUCOMISS (DI), X1
+	JNE      hammingDiffers
+	JPS      hammingDiffers
+	JMP      hammingNext
+
+hammingDiffers:
+	INCQ AX
+
+hammingNext:
+	ADDQ $4, SI
+	ADDQ $4, DI
+	DECQ CX
+	JMP  hammingTail
+
+hammingDone:
+	VZEROUPPER
+	CVTSQ2SS AX, X0
+	MOVSS    X0, ret+48(FP)
+	RET
+
+// func cpuid(eaxArg, ecxArg uint32) (eax, ebx, ecx, edx uint32)
+TEXT ·cpuid(SB), NOSPLIT, $0-24
+	MOVL eaxArg+0(FP), AX
+	MOVL ecxArg+4(FP), CX
+	CPUID
+	MOVL AX, eax+8(FP)
+	MOVL BX, ebx+12(FP)
+	MOVL CX, ecx+16(FP)
+	MOVL DX, edx+20(FP)
+	RET
+
+// func xgetbv() (eax, edx uint32)
+TEXT ·xgetbv(SB), NOSPLIT, $0-8
+	MOVL $0, CX
+	XGETBV
+	MOVL AX, eax+0(FP)
+	MOVL DX, edx+4(FP)
+	RET
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// the reference implementations are as simple as possible and accumulate in
+// float64, so the optimized kernels can be checked against them
+func dotProductReference(a, b []float32) float32 {
+	var sum float64
+	for i := range a {
+		sum += float64(a[i]) * float64(b[i])
+	}
+	return float32(sum)
+}
+
+func squaredL2Reference(a, b []float32) float32 {
+	var sum float64
+	for i := range a {
+		diff := float64(a[i]) - float64(b[i])
+		sum += diff * diff
+	}
+	return float32(sum)
+}
+
+func manhattanReference(a, b []float32) float32 {
+	var sum float64
+	for i := range a {
+		sum += math.Abs(float64(a[i]) - float64(b[i]))
+	}
+	return float32(sum)
+}
+
+func hammingReference(a, b []float32) float32 {
+	var sum float32
+	for i := range a {
+		if a[i] != b[i] {
+			sum++
+		}
+	}
+	return sum
+}
+
+type distanceKernel func(a, b []float32) float32
+
+func TestDistanceKernels(t *testing.T) {
+	t.Logf("selected kernels: %s", distanceKernels)
+
+	tests := []struct {
+		name      string
+		reference distanceKernel
+		kernels   map[string]distanceKernel
+	}{
+		{"dot product", dotProductReference,
+			map[string]distanceKernel{"go": dotProductGo, "selected": dotProductImpl}},
+		{"squared l2", squaredL2Reference,
+			map[string]distanceKernel{"go": squaredL2Go, "selected": squaredL2Impl}},
+		{"manhattan", manhattanReference,
+			map[string]distanceKernel{"go": manhattanGo, "selected": manhattanImpl}},
+		{"hamming", hammingReference,
+			map[string]distanceKernel{"go": hammingGo, "selected": hammingImpl}},
+	}
+
+	r := rand.New(rand.NewSource(7))
+	// every remainder of the unrolled and vectorized loops, plus the real size
+	lengths := []int{vectorDimensions}
+	for l := 0; l <= 70; l++ {
+		lengths = append(lengths, l)
+	}
+
+	for _, test := range tests {
+		for name, kernel := range test.kernels {
+			t.Run(fmt.Sprintf("%s/%s", test.name, name), func(t *testing.T) {
+				for _, l := range lengths {
+					vectors := randomVectors(r, 2, l)
+					a, b := vectors[0], vectors[1]
+					// exercise hamming with some identical dimensions
+					for d := 0; d < l; d += 3 {
+						b[d] = a[d]
+					}
+
+					expected := test.reference(a, b)
+					actual := kernel(a, b)
+					tolerance := 1e-5 * float32(math.Max(1, math.Abs(float64(expected))))
+					if diff := actual - expected; diff > tolerance || diff < -tolerance {
+						t.Errorf("length %d: expected %f, got %f", l, expected, actual)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkDistanceKernels(b *testing.B) {
+	vectors := randomVectors(rand.New(rand.NewSource(7)), 2, vectorDimensions)
+	x, y := vectors[0], vectors[1]
+
+	for _, bench := range []struct {
+		name   string
+		kernel distanceKernel
+	}{
+		{"dot product reference", dotProductReference},
+		{"dot product go", dotProductGo},
+		{"dot product selected", dotProductImpl},
+		{"squared l2 reference", squaredL2Reference},
+		{"squared l2 go", squaredL2Go},
+		{"squared l2 selected", squaredL2Impl},
+		{"manhattan go", manhattanGo},
+		{"manhattan selected", manhattanImpl},
+		{"hamming go", hammingGo},
+		{"hamming selected", hammingImpl},
+		{"cosine", cosineDist},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				bench.kernel(x, y)
+			}
+		})
+	}
+}
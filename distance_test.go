@@ -0,0 +1,80 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestDistanceProviders(t *testing.T) {
+	m = newMonitoring()
+
+	a := []float32{1, 2, 3}
+	b := []float32{3, 2, -1}
+
+	tests := []struct {
+		metric   distanceMetric
+		expected float32
+	}{
+		{metricCosine, 1 - 4/(3.7416575*3.7416575)},
+		{metricDotProduct, -4},
+		{metricSquaredL2, 4 + 0 + 16},
+		{metricManhattan, 2 + 0 + 4},
+		{metricHamming, 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.metric.String(), func(t *testing.T) {
+			d, err := newDistanceProvider(test.metric)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if d.metric() != test.metric {
+				t.Errorf("expected metric %s, got %s", test.metric, d.metric())
+			}
+
+			dist := d.distance(a, b)
+			if diff := dist - test.expected; diff > 1e-5 || diff < -1e-5 {
+				t.Errorf("expected distance %f, got %f", test.expected, dist)
+			}
+
+			parsed, err := parseDistanceMetric(test.metric.String())
+			if err != nil || parsed != test.metric {
+				t.Errorf("could not parse %q back into the metric: %v", test.metric, err)
+			}
+		})
+	}
+}
+
+func TestNormalizedCosineDistancer(t *testing.T) {
+	m = newMonitoring()
+
+	vectors := randomVectors(rand.New(rand.NewSource(7)), 50, 32)
+	for i := 1; i < len(vectors); i++ {
+		a, b := vectors[i-1], vectors[i]
+		expected := cosineDistancer{}.distance(a, b)
+		actual := normalizedCosineDistancer{}.distance(normalizeVector(a), normalizeVector(b))
+		if diff := actual - expected; diff > 1e-5 || diff < -1e-5 {
+			t.Errorf("expected distance %f, got %f", expected, actual)
+		}
+	}
+
+	t.Run("input is not modified", func(t *testing.T) {
+		v := []float32{3, 4}
+		normalized := normalizeVector(v)
+		if v[0] != 3 || v[1] != 4 {
+			t.Errorf("expected input to be unchanged, got %v", v)
+		}
+
+		if normalized[0] != 0.6 || normalized[1] != 0.8 {
+			t.Errorf("expected [0.6 0.8], got %v", normalized)
+		}
+	})
+
+	t.Run("zero vector", func(t *testing.T) {
+		normalized := normalizeVector([]float32{0, 0})
+		if normalized[0] != 0 || normalized[1] != 0 {
+			t.Errorf("expected zero vector, got %v", normalized)
+		}
+	})
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// evaluationResult describes the quality and cost of the search with a single
+// ef. Latencies and distance computations are per query.
+type evaluationResult struct {
+	Ef                   int     `json:"ef"`
+	Recall               float64 `json:"recall"`
+	MeanLatency          string  `json:"meanLatency"`
+	P99Latency           string  `json:"p99Latency"`
+	DistanceComputations float64 `json:"distanceComputations"`
+}
+
+type evaluationReport struct {
+	K       int                `json:"k"`
+	Queries int                `json:"queries"`
+	Nodes   int                `json:"nodes"`
+	Results []evaluationResult `json:"results"`
+}
+
+// evaluate measures recall@k of the approximate search against the exact
+// search for every ef. The queries run one after another, so that latencies
+// are not distorted. It must not run while the graph is being modified.
+func (h *hnsw) evaluate(queries [][]float32, k int, efs []int) evaluationReport {
+	groundTruth := make([]map[int]struct{}, len(queries))
+	for i, query := range queries {
+		groundTruth[i] = map[int]struct{}{}
+		for _, res := range h.exactSearchByVector(query, k, nil) {
+			groundTruth[i][res.id] = struct{}{}
+		}
+	}
+
+	h.RLock()
+	nodes := h.nodes.len()
+	h.RUnlock()
+
+	report := evaluationReport{K: k, Queries: len(queries), Nodes: nodes}
+	for _, ef := range efs {
+		latencies := make([]time.Duration, len(queries))
+		var total time.Duration
+		var hits, expected int
+
+		var distances int
+		for i, query := range queries {
+			before := time.Now()
+			res, computed := h.countedKnnSearchByVector(query, k, ef, nil, nil)
+			latencies[i] = time.Since(before)
+			total += latencies[i]
+			distances += computed
+
+			for _, elem := range res {
+				if _, ok := groundTruth[i][elem.id]; ok {
+					hits++
+				}
+			}
+			expected += len(groundTruth[i])
+		}
+
+		result := evaluationResult{Ef: ef}
+		if expected > 0 {
+			result.Recall = float64(hits) / float64(expected)
+		}
+		if len(queries) > 0 {
+			result.MeanLatency = fmt.Sprintf("%s", total/time.Duration(len(queries)))
+			result.P99Latency = fmt.Sprintf("%s", percentile(latencies, 0.99))
+			result.DistanceComputations = float64(distances) / float64(len(queries))
+		}
+
+		report.Results = append(report.Results, result)
+	}
+
+	return report
+}
+
+// sampleQueries picks the vectors of random nodes as queries. The nodes stay
+// part of the graph, so each of them is its own nearest neighbor in both the
+// exact and the approximate search.
+func (h *hnsw) sampleQueries(r *rand.Rand, amount int) [][]float32 {
+	h.RLock()
+	ids := make([]int, 0, h.nodes.len())
+	h.nodes.forEach(func(node *hnswVertex) {
+		ids = append(ids, node.id)
+	})
+	h.RUnlock()
+
+	r.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+	if amount < len(ids) {
+		ids = ids[:amount]
+	}
+
+	out := make([][]float32, len(ids))
+	for i, id := range ids {
+		out[i] = h.vectorForID(id)
+	}
+
+	return out
+}
+
+// percentile uses the nearest-rank method, durations are sorted in place
+func percentile(durations []time.Duration, p float64) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+
+	sort.Slice(durations, func(a, b int) bool { return durations[a] < durations[b] })
+	rank := int(math.Ceil(p*float64(len(durations)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+
+	return durations[rank]
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestEvaluate(t *testing.T) {
+	vectors := randomVectors(rand.New(rand.NewSource(7)), 500, 16)
+	h := buildTestGraph(t, vectors, testConfig())
+
+	queries := h.sampleQueries(rand.New(rand.NewSource(8)), 50)
+	if len(queries) != 50 {
+		t.Fatalf("expected 50 queries, got %d", len(queries))
+	}
+
+	report := h.evaluate(queries, 10, []int{10, 500})
+	if report.K != 10 || report.Queries != 50 || report.Nodes != 500 || len(report.Results) != 2 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	low, high := report.Results[0], report.Results[1]
+	if high.Recall != 1 {
+		t.Errorf("expected perfect recall with ef covering the whole graph, got %f", high.Recall)
+	}
+
+	if low.Recall > high.Recall {
+		t.Errorf("expected recall to grow with ef, got %f and %f", low.Recall, high.Recall)
+	}
+
+	if low.DistanceComputations <= 0 || low.DistanceComputations >= high.DistanceComputations {
+		t.Errorf("expected distance computations to grow with ef, got %f and %f",
+			low.DistanceComputations, high.DistanceComputations)
+	}
+
+	for _, res := range report.Results {
+		if _, err := time.ParseDuration(res.P99Latency); err != nil {
+			t.Errorf("invalid p99 latency %q: %v", res.P99Latency, err)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	durations := make([]time.Duration, 100)
+	for i := range durations {
+		durations[i] = time.Duration(100-i) * time.Millisecond
+	}
+
+	if p := percentile(durations, 0.99); p != 99*time.Millisecond {
+		t.Errorf("expected p99 of 99ms, got %s", p)
+	}
+
+	if p := percentile(durations, 0.5); p != 50*time.Millisecond {
+		t.Errorf("expected p50 of 50ms, got %s", p)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+// exactSearchByVector compares the query with every node of the graph and
+// returns the k closest ones. It is far too slow to serve queries, but its
+// results are the ground truth which the approximate search is measured
+// against. Deleted nodes and nodes outside of allow are skipped, just like in
+// knnSearchByVector.
+func (h *hnsw) exactSearchByVector(queryVector []float32, k int, allow allowList) []searchResult {
+	res, _ := h.countedExactSearchByVector(h.prepareQuery(queryVector), k, allow, nil)
+	return res
+}
+
+// countedExactSearchByVector expects a prepared query and also returns the
+// number of distances calculated. Once the budget is exceeded, the remaining
+// nodes are skipped.
+func (h *hnsw) countedExactSearchByVector(queryVector []float32, k int, allow allowList,
+	budget *searchBudget) ([]searchResult, int) {
+	h.RLock()
+	nodes := h.nodes.snapshot()
+	h.RUnlock()
+
+	var distances int
+	results := newMaxPriorityQueue(k + 1)
+	nodes.forEach(func(node *hnswVertex) {
+		if !h.isAllowedResult(node.id, allow) {
+			return
+		}
+
+		if distances%searchBudgetCheckInterval == 0 && budget.expired() {
+			return
+		}
+
+		distances++
+		dist := h.distancer.distance(h.vectorForID(node.id), queryVector)
+		if results.len() < k || dist < results.top().dist {
+			results.insert(node.id, dist)
+			if results.len() > k {
+				results.pop()
+			}
+		}
+	})
+
+	sorted := results.sorted()
+	out := make([]searchResult, len(sorted))
+	for i, elem := range sorted {
+		out[i] = searchResult{id: elem.id, distance: elem.dist}
+	}
+
+	return out, distances
+}
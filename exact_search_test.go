@@ -0,0 +1,45 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestExactSearch(t *testing.T) {
+	vectors := randomVectors(rand.New(rand.NewSource(7)), 200, 16)
+	cfg := testConfig()
+	cfg.distancer = squaredL2Distancer{}
+	h := buildTestGraph(t, vectors, cfg)
+
+	if err := h.delete(4); err != nil {
+		t.Fatal(err)
+	}
+
+	query := randomVectors(rand.New(rand.NewSource(8)), 1, 16)[0]
+	allow := newIDSetAllowList(2, 4, 6, 8, 10, 12)
+
+	// brute force by sorting every allowed, non-deleted node
+	var expected []int
+	for i := range vectors {
+		if i != 4 && allow.contains(i) {
+			expected = append(expected, i)
+		}
+	}
+	sort.Slice(expected, func(a, b int) bool {
+		return h.distancer.distance(vectors[expected[a]], query) <
+			h.distancer.distance(vectors[expected[b]], query)
+	})
+	expected = expected[:3]
+
+	res := h.exactSearchByVector(query, 3, allow)
+	if len(res) != len(expected) {
+		t.Fatalf("expected %d results, got %d", len(expected), len(res))
+	}
+
+	for i := range res {
+		if res[i].id != expected[i] {
+			t.Errorf("position %d: expected %d, got %d", i, expected[i], res[i].id)
+		}
+	}
+}
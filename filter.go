@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// filter restricts a search to objects whose properties match. Every filter
+// is exactly one of: a combination of other filters with and, or or not, or
+// a condition on a single property with equals, in or a range (any of gt,
+// gte, lt and lte). For example:
+//
+//	{"and": [
+//	  {"property": "category", "equals": "news"},
+//	  {"property": "published", "gte": "2020-01-01T00:00:00Z"},
+//	  {"not": {"property": "language", "in": ["de", "fr"]}}
+//	]}
+//
+// Objects without the property never match a condition on it, but they do
+// match its negation.
+type filter struct {
+	And []*filter `json:"and"`
+	Or  []*filter `json:"or"`
+	Not *filter   `json:"not"`
+
+	Property string        `json:"property"`
+	Equals   interface{}   `json:"equals"`
+	In       []interface{} `json:"in"`
+	Gt       interface{}   `json:"gt"`
+	Gte      interface{}   `json:"gte"`
+	Lt       interface{}   `json:"lt"`
+	Lte      interface{}   `json:"lte"`
+}
+
+func parseFilter(in []byte) (*filter, error) {
+	var f filter
+	if err := json.Unmarshal(in, &f); err != nil {
+		return nil, fmt.Errorf("invalid filter: %v", err)
+	}
+
+	return &f, nil
+}
+
+// compile evaluates the filter against the property indexes. objects is the
+// number of internal ids handed out so far, negations are relative to them.
+func (f *filter) compile(p *propertyStore, objects int) (*bitmapAllowList, error) {
+	var set int
+	for _, isSet := range []bool{f.And != nil, f.Or != nil, f.Not != nil, f.Property != ""} {
+		if isSet {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, fmt.Errorf("filter must have exactly one of and, or, not and property")
+	}
+
+	switch {
+	case f.And != nil || f.Or != nil:
+		operands := f.And
+		if f.Or != nil {
+			operands = f.Or
+		}
+
+		if len(operands) == 0 {
+			return nil, fmt.Errorf("and/or need at least one operand")
+		}
+
+		var out *bitmapAllowList
+		for _, operand := range operands {
+			if operand == nil {
+				return nil, fmt.Errorf("and/or operands must not be null")
+			}
+
+			res, err := operand.compile(p, objects)
+			if err != nil {
+				return nil, err
+			}
+
+			switch {
+			case out == nil:
+				out = res
+			case f.And != nil:
+				out = out.intersect(res)
+			default:
+				out = out.union(res)
+			}
+		}
+
+		return out, nil
+	case f.Not != nil:
+		res, err := f.Not.compile(p, objects)
+		if err != nil {
+			return nil, err
+		}
+
+		return res.complement(objects), nil
+	default:
+		return f.compileCondition(p)
+	}
+}
+
+func (f *filter) compileCondition(p *propertyStore) (*bitmapAllowList, error) {
+	hasRange := f.Gt != nil || f.Gte != nil || f.Lt != nil || f.Lte != nil
+	var set int
+	for _, isSet := range []bool{f.Equals != nil, f.In != nil, hasRange} {
+		if isSet {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, fmt.Errorf("property %q: must have exactly one of equals, in and a range",
+			f.Property)
+	}
+
+	out := newBitmapAllowList()
+	switch {
+	case f.Equals != nil || f.In != nil:
+		values := f.In
+		if f.Equals != nil {
+			values = []interface{}{f.Equals}
+		}
+
+		for _, in := range values {
+			value, err := parsePropertyValue(in)
+			if err != nil {
+				return nil, fmt.Errorf("property %q: %v", f.Property, err)
+			}
+			p.equal(f.Property, value, out)
+		}
+	default:
+		if f.Gt != nil && f.Gte != nil || f.Lt != nil && f.Lte != nil {
+			return nil, fmt.Errorf("property %q: at most one lower and one upper bound allowed",
+				f.Property)
+		}
+
+		lower, includeLower, err := parseBound(f.Gt, f.Gte)
+		if err != nil {
+			return nil, fmt.Errorf("property %q: %v", f.Property, err)
+		}
+
+		upper, includeUpper, err := parseBound(f.Lt, f.Lte)
+		if err != nil {
+			return nil, fmt.Errorf("property %q: %v", f.Property, err)
+		}
+
+		if lower != nil && upper != nil && lower.kind != upper.kind {
+			return nil, fmt.Errorf("property %q: cannot compare a %s with a %s",
+				f.Property, lower.kind, upper.kind)
+		}
+
+		p.between(f.Property, lower, upper, includeLower, includeUpper, out)
+	}
+
+	return out, nil
+}
+
+// parseBound returns nil if neither the exclusive nor the inclusive bound is
+// set
+func parseBound(exclusive, inclusive interface{}) (*propertyValue, bool, error) {
+	in, including := exclusive, false
+	if inclusive != nil {
+		in, including = inclusive, true
+	}
+
+	if in == nil {
+		return nil, false, nil
+	}
+
+	value, err := parsePropertyValue(in)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &value, including, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	p, err := newPropertyStore(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for id, props := range []map[string]interface{}{
+		{"category": "news", "price": 12.5, "published": "2020-06-01T12:00:00Z"},
+		{"category": "sports", "price": 3.0, "premium": true},
+		{"category": "news", "price": 40.0, "published": "2021-01-01T00:00:00Z"},
+		{"category": "weather", "price": 40.0, "premium": false},
+		{"category": "news"},
+	} {
+		if err := p.set(id, props); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// object 5 exists, but has no properties
+	const objects = 6
+
+	tests := []struct {
+		name     string
+		filter   string
+		expected []int
+		err      string
+	}{
+		{"equals", `{"property": "category", "equals": "news"}`, []int{0, 2, 4}, ""},
+		{"equals bool", `{"property": "premium", "equals": false}`, []int{3}, ""},
+		{"equals unknown", `{"property": "color", "equals": "red"}`, nil, ""},
+		{"in", `{"property": "category", "in": ["sports", "weather"]}`, []int{1, 3}, ""},
+		{"range", `{"property": "price", "gt": 3, "lte": 40}`, []int{0, 2, 3}, ""},
+		{"open range", `{"property": "price", "lt": 40}`, []int{0, 1}, ""},
+		{"date range", `{"property": "published", "gte": "2020-12-31T00:00:00+01:00"}`, []int{2}, ""},
+		{"and", `{"and": [{"property": "category", "equals": "news"},
+			{"property": "price", "gte": 20}]}`, []int{2}, ""},
+		{"or", `{"or": [{"property": "premium", "equals": true},
+			{"property": "price", "equals": 12.5}]}`, []int{0, 1}, ""},
+		{"not", `{"not": {"property": "category", "equals": "news"}}`, []int{1, 3, 5}, ""},
+		{"nested", `{"and": [{"not": {"property": "premium", "equals": true}},
+			{"or": [{"property": "category", "equals": "weather"},
+				{"property": "published", "lt": "2021-01-01T00:00:00Z"}]}]}`, []int{0, 3}, ""},
+		{"mixed", `{"property": "price", "equals": 3, "gt": 1}`, nil, "exactly one of equals"},
+		{"empty", `{}`, nil, "exactly one of and"},
+		{"empty and", `{"and": []}`, nil, "at least one operand"},
+		{"two lower bounds", `{"property": "price", "gt": 1, "gte": 1}`, nil, "at most one lower"},
+		{"different kinds", `{"property": "price", "gt": 1, "lt": "z"}`, nil, "cannot compare"},
+		{"unsupported value", `{"property": "price", "equals": [1]}`, nil, "unsupported"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, err := parseFilter([]byte(test.filter))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			res, err := f.compile(p, objects)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if res.len() != len(test.expected) {
+				t.Errorf("expected %d matches, got %d", len(test.expected), res.len())
+			}
+
+			for _, id := range test.expected {
+				if !res.contains(id) {
+					t.Errorf("expected %d to match", id)
+				}
+			}
+		})
+	}
+}
+
+func TestBitmapAllowListOperations(t *testing.T) {
+	a := newBitmapAllowList(1, 64, 130)
+	b := newBitmapAllowList(1, 2, 130, 200)
+
+	for _, test := range []struct {
+		name     string
+		list     *bitmapAllowList
+		expected []int
+	}{
+		{"intersect", a.intersect(b), []int{1, 130}},
+		{"union", a.union(b), []int{1, 2, 64, 130, 200}},
+		{"complement", a.complement(66), rangeExcept(66, 1, 64)},
+	} {
+		if test.list.len() != len(test.expected) {
+			t.Errorf("%s: expected %d ids, got %d", test.name, len(test.expected), test.list.len())
+		}
+
+		for _, id := range test.expected {
+			if !test.list.contains(id) {
+				t.Errorf("%s: expected %d to be contained", test.name, id)
+			}
+		}
+	}
+}
+
+// rangeExcept returns 0..size-1 without the excluded ids
+func rangeExcept(size int, excluded ...int) []int {
+	var out []int
+	for i := 0; i < size; i++ {
+		if !containsInt(excluded, i) {
+			out = append(out, i)
+		}
+	}
+
+	return out
+}
+
+func containsInt(ids []int, needle int) bool {
+	for _, id := range ids {
+		if id == needle {
+			return true
+		}
+	}
+
+	return false
+}
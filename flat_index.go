@@ -0,0 +1,318 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// flatIndex answers every query by comparing it with all indexed vectors. For
+// small collections this is exact and cheaper than a graph, which needs a map
+// and a lock per node and a commit log event per link. Once the index holds
+// promotionThreshold vectors, it builds an hnsw graph from them in the
+// background. It keeps serving queries and applying changes in the meantime.
+// The changes made during the build are replayed onto the graph before every
+// call is delegated to it.
+type flatIndex struct {
+	sync.RWMutex
+
+	distancer          distanceProvider
+	vectorForID        func(id int) []float32
+	promotionThreshold int
+
+	// newGraph creates the empty graph the index is promoted to
+	newGraph func() *hnsw
+
+	// members is dense for fast scans, positions points into it so that
+	// deletes don't need to search it
+	members   []int
+	positions map[int]int
+
+	// pending is only recorded while the graph is being built
+	promoting bool
+	pending   []flatChange
+
+	// set once the promotion is complete, never unset again
+	graph *hnsw
+}
+
+type flatChangeKind uint8
+
+const (
+	flatChangeAdd flatChangeKind = iota
+	flatChangeUpdate
+	flatChangeDelete
+)
+
+type flatChange struct {
+	kind flatChangeKind
+	id   int
+}
+
+type flatConfig struct {
+	// defaults to cosine distance if nil
+	distancer distanceProvider
+
+	// the number of vectors at which the index is promoted to a graph, 0 never
+	// promotes
+	promotionThreshold int
+
+	newGraph func() *hnsw
+}
+
+func newFlatIndex(cfg flatConfig, vectorForID func(id int) []float32) *flatIndex {
+	distancer := cfg.distancer
+	if distancer == nil {
+		distancer = cosineDistancer{}
+	}
+
+	return &flatIndex{
+		distancer:          distancer,
+		vectorForID:        vectorForID,
+		promotionThreshold: cfg.promotionThreshold,
+		newGraph:           cfg.newGraph,
+		positions:          map[int]int{},
+	}
+}
+
+// promoted returns the graph once the promotion is complete, otherwise nil
+func (f *flatIndex) promoted() *hnsw {
+	f.RLock()
+	defer f.RUnlock()
+	return f.graph
+}
+
+func (f *flatIndex) add(id int) {
+	if g := f.promoted(); g != nil {
+		g.add(id)
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	if f.graph != nil {
+		// promoted in the meantime
+		f.graph.add(id)
+		return
+	}
+
+	if _, ok := f.positions[id]; ok {
+		f.record(flatChangeUpdate, id)
+		return
+	}
+
+	f.positions[id] = len(f.members)
+	f.members = append(f.members, id)
+	f.record(flatChangeAdd, id)
+
+	if !f.promoting && f.promotionThreshold > 0 && len(f.members) >= f.promotionThreshold {
+		f.promoting = true
+		snapshot := make([]int, len(f.members))
+		copy(snapshot, f.members)
+		go f.promote(snapshot)
+	}
+}
+
+// update only needs to be recorded, the vector is read again on every search
+func (f *flatIndex) update(id int) error {
+	if g := f.promoted(); g != nil {
+		return g.update(id)
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	if f.graph != nil {
+		return f.graph.update(id)
+	}
+
+	if _, ok := f.positions[id]; !ok {
+		return fmt.Errorf("node %d does not exist", id)
+	}
+
+	f.record(flatChangeUpdate, id)
+	return nil
+}
+
+func (f *flatIndex) delete(id int) error {
+	if g := f.promoted(); g != nil {
+		return g.delete(id)
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	if f.graph != nil {
+		return f.graph.delete(id)
+	}
+
+	pos, ok := f.positions[id]
+	if !ok {
+		return fmt.Errorf("node %d does not exist", id)
+	}
+
+	last := f.members[len(f.members)-1]
+	f.members[pos] = last
+	f.positions[last] = pos
+	f.members = f.members[:len(f.members)-1]
+	delete(f.positions, id)
+
+	f.record(flatChangeDelete, id)
+	return nil
+}
+
+// record must be called with f locked
+func (f *flatIndex) record(kind flatChangeKind, id int) {
+	if f.promoting {
+		f.pending = append(f.pending, flatChange{kind: kind, id: id})
+	}
+}
+
+// promote builds the graph from snapshot without holding the lock. Only the
+// replay of the changes made in the meantime blocks other calls.
+func (f *flatIndex) promote(snapshot []int) {
+	before := time.Now()
+	g := f.newGraph()
+
+	ids := make(chan int)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range ids {
+				g.add(id)
+			}
+		}()
+	}
+
+	for _, id := range snapshot {
+		ids <- id
+	}
+	close(ids)
+	wg.Wait()
+
+	f.Lock()
+	defer f.Unlock()
+
+	for _, change := range f.pending {
+		var err error
+		switch change.kind {
+		case flatChangeAdd:
+			g.add(change.id)
+		case flatChangeUpdate:
+			err = g.update(change.id)
+		case flatChangeDelete:
+			err = g.delete(change.id)
+		}
+
+		if err != nil {
+			log.Printf("promotion of flat index: replay change to %d: %v", change.id, err)
+		}
+	}
+
+	log.Printf("promoted flat index with %d vectors to a graph in %s, replayed %d changes",
+		len(f.members), time.Since(before), len(f.pending))
+
+	// members is kept, searches which started just before the promotion
+	// still scan it
+	f.graph = g
+	f.pending = nil
+}
+
+func (f *flatIndex) knnSearchByVectorWithBudget(queryVector []float32, k int, ef int,
+	allow allowList, budget *searchBudget) []searchResult {
+	if g := f.promoted(); g != nil {
+		return g.knnSearchByVectorWithBudget(queryVector, k, ef, allow, budget)
+	}
+
+	queryVector = prepareQueryFor(f.distancer, queryVector)
+	results := newMaxPriorityQueue(k + 1)
+	f.scan(queryVector, allow, budget, func(id int, dist float32) {
+		if results.len() < k || dist < results.top().dist {
+			results.insert(id, dist)
+			if results.len() > k {
+				results.pop()
+			}
+		}
+	})
+
+	sorted := results.sorted()
+	out := make([]searchResult, len(sorted))
+	for i, elem := range sorted {
+		out[i] = searchResult{id: elem.id, distance: elem.dist}
+	}
+
+	return out
+}
+
+// rangeSearchByVector is exact for a flat index and never limited, so ef and
+// maxEf are only passed on to the graph after the promotion
+func (f *flatIndex) rangeSearchByVector(queryVector []float32, maxDistance float32, ef int, maxEf int,
+	allow allowList, budget *searchBudget) ([]searchResult, bool) {
+	if g := f.promoted(); g != nil {
+		return g.rangeSearchByVector(queryVector, maxDistance, ef, maxEf, allow, budget)
+	}
+
+	queryVector = prepareQueryFor(f.distancer, queryVector)
+	var out []searchResult
+	f.scan(queryVector, allow, budget, func(id int, dist float32) {
+		if dist <= maxDistance {
+			out = append(out, searchResult{id: id, distance: dist})
+		}
+	})
+
+	sort.Slice(out, func(a, b int) bool {
+		return out[a].distance < out[b].distance
+	})
+
+	return out, false
+}
+
+// scan calls fn with the distance of every allowed vector until the budget is
+// exceeded
+func (f *flatIndex) scan(queryVector []float32, allow allowList, budget *searchBudget,
+	fn func(id int, dist float32)) {
+	f.RLock()
+	defer f.RUnlock()
+
+	for i, id := range f.members {
+		if i%searchBudgetCheckInterval == 0 && budget.expired() {
+			return
+		}
+
+		if allow != nil && !allow.contains(id) {
+			continue
+		}
+
+		fn(id, f.distancer.distance(f.vectorForID(id), queryVector))
+	}
+}
+
+func (f *flatIndex) contains(id int) bool {
+	if g := f.promoted(); g != nil {
+		return g.contains(id)
+	}
+
+	f.RLock()
+	defer f.RUnlock()
+
+	if f.graph != nil {
+		return f.graph.contains(id)
+	}
+
+	_, ok := f.positions[id]
+	return ok
+}
+
+func (f *flatIndex) vectorOf(id int) []float32 {
+	return f.vectorForID(id)
+}
+
+func (f *flatIndex) metric() distanceMetric {
+	return f.distancer.metric()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestFlatIndex(t *testing.T) {
+	vectors := randomVectors(rand.New(rand.NewSource(7)), 600, 32)
+	cfg := testConfig()
+	cfg.maximumConnections = 16
+	cfg.distancer = squaredL2Distancer{}
+
+	// compare with a graph that holds the same vectors
+	exact := buildTestGraph(t, vectors[:299], cfg)
+
+	graphs := make(chan *hnsw, 1)
+	f := newFlatIndex(flatConfig{
+		distancer:          squaredL2Distancer{},
+		promotionThreshold: 300,
+		newGraph: func() *hnsw {
+			g := newTestHnsw(t, cfg, func(id int) []float32 { return vectors[id] })
+			graphs <- g
+			return g
+		},
+	}, func(id int) []float32 { return vectors[id] })
+
+	for i := 0; i < 299; i++ {
+		f.add(i)
+	}
+
+	t.Run("exact before the promotion", func(t *testing.T) {
+		query := vectors[599]
+		allow := newIDSetAllowList(1, 2, 3, 5, 8, 13, 21, 34, 55, 89)
+		expected := exact.exactSearchByVector(query, 5, allow)
+		res := f.knnSearchByVectorWithBudget(query, 5, 5, allow, nil)
+		if len(res) != len(expected) {
+			t.Fatalf("expected %d results, got %d", len(expected), len(res))
+		}
+
+		for i := range res {
+			if res[i].id != expected[i].id {
+				t.Errorf("position %d: expected %d, got %d", i, expected[i].id, res[i].id)
+			}
+		}
+
+		within, _ := f.rangeSearchByVector(query, expected[2].distance, 1, 1, allow, nil)
+		if len(within) != 3 {
+			t.Errorf("expected 3 results within the distance of the third, got %d", len(within))
+		}
+
+		if f.promoted() != nil {
+			t.Errorf("expected no promotion below the threshold")
+		}
+	})
+
+	t.Run("keeps serving and applying changes during the promotion", func(t *testing.T) {
+		for i := 299; i < 600; i++ {
+			f.add(i)
+			if i%10 == 0 {
+				if err := f.delete(i - 200); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if res := f.knnSearchByVectorWithBudget(vectors[i], 1, 16, nil, nil); len(res) != 1 || res[0].id != i {
+				t.Fatalf("expected %d to find itself, got %v", i, res)
+			}
+		}
+
+		if err := f.delete(1000); err == nil {
+			t.Errorf("expected an error when deleting an unknown id")
+		}
+
+		g := <-graphs
+		deadline := time.Now().Add(10 * time.Second)
+		for f.promoted() == nil {
+			if time.Now().After(deadline) {
+				t.Fatal("index was not promoted in time")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if f.promoted() != g {
+			t.Fatal("expected the index to delegate to the promoted graph")
+		}
+
+		for i := 0; i < 600; i++ {
+			deleted := i >= 99 && i < 400 && (i+200)%10 == 0
+			if deleted != g.hasTombstone(i) {
+				t.Errorf("id %d: expected deleted to be %t", i, deleted)
+			}
+
+			res := f.knnSearchByVectorWithBudget(vectors[i], 1, 64, nil, nil)
+			if !deleted && (len(res) != 1 || res[0].id != i) {
+				t.Errorf("expected %d to find itself after the promotion, got %v", i, res)
+			}
+		}
+	})
+}
@@ -36,7 +36,27 @@ type hnsw struct {
 
 	levelNormalizer float64
 
-	nodes []*hnswVertex
+	// source for the level of new nodes, a per-index source makes builds
+	// reproducible as long as the nodes are inserted in the same order
+	randomSource *rand.Rand
+	randomLock   sync.Mutex
+
+	neighborSelection neighborSelection
+
+	distancer distanceProvider
+
+	nodes hnswNodes
+
+	// deleted nodes which are still present in the graph until the next
+	// cleanup, see hnsw_delete.go
+	tombstones    map[int]struct{}
+	tombstoneLock sync.RWMutex
+
+	visitedLists *visitedListPool
+
+	// keeps compact copies of the vectors in memory, nil if the graph is not
+	// compressed, see compression.go
+	compressor vectorCompressor
 
 	vectorForID func(id int) []float32
 
@@ -54,15 +74,48 @@ type hnsw struct {
 
 type hnswLayer struct{}
 
-func newHnsw(id string, maximumConnections int, efConstruction int, vectorForID func(id int) []float32) *hnsw {
+type hnswConfig struct {
+	// Each node should not have more edges than this number
+	maximumConnections int
+
+	// ef parameter used in construction phases, should be higher than ef during querying
+	efConstruction int
+
+	// which algorithm to use when picking the neighbors of a new node or when
+	// pruning the connections of an existing node
+	neighborSelection neighborSelection
+
+	// defaults to cosine distance if nil
+	distancer distanceProvider
+
+	// seeds the level generator, the same seed and the same order of inserts
+	// lead to an identical graph
+	randomSeed int64
+}
+
+func newHnsw(id string, cfg hnswConfig, vectorForID func(id int) []float32) *hnsw {
+	return newHnswWithCommitLogger(id, cfg, vectorForID, newHnswCommitLogger(commitLogPathFor(id)))
+}
+
+func newHnswWithCommitLogger(id string, cfg hnswConfig, vectorForID func(id int) []float32,
+	commitLog *hnswCommitLogger) *hnsw {
+	distancer := cfg.distancer
+	if distancer == nil {
+		distancer = cosineDistancer{}
+	}
+
 	return &hnsw{
-		maximumConnections:          maximumConnections,
-		maximumConnectionsLayerZero: 2 * maximumConnections,                    // inspired by original paper and other implementations
-		levelNormalizer:             1 / math.Log(float64(maximumConnections)), // inspired by c++ implementation
-		efConstruction:              efConstruction,
-		nodes:                       make([]*hnswVertex, 0, 100000), // TODO: grow variably rather than fixed length
+		maximumConnections:          cfg.maximumConnections,
+		maximumConnectionsLayerZero: 2 * cfg.maximumConnections,                    // inspired by original paper and other implementations
+		levelNormalizer:             1 / math.Log(float64(cfg.maximumConnections)), // inspired by c++ implementation
+		randomSource:                rand.New(rand.NewSource(cfg.randomSeed)),
+		efConstruction:              cfg.efConstruction,
+		neighborSelection:           cfg.neighborSelection,
+		distancer:                   distancer,
 		vectorForID:                 vectorForID,
-		commitLog:                   newHnswCommitLogger(),
+		commitLog:                   commitLog,
+		tombstones:                  map[int]struct{}{},
+		visitedLists:                newVisitedListPool(),
 		id:                          id,
 	}
 
@@ -71,12 +124,9 @@ func newHnsw(id string, maximumConnections int, efConstruction int, vectorForID
 func (h *hnsw) insertFromExternal(nodeId, targetLevel int, neighborsAtLevel map[int][]uint32) {
 	defer m.addBuildingReplication(time.Now())
 
-	var node *hnswVertex
 	h.RLock()
-	total := len(h.nodes)
-	if total > nodeId {
-		node = h.nodes[nodeId] // it could be that we implicitly added this node already because it was referenced
-	}
+	total := h.nodes.len()
+	node := h.nodes.get(nodeId) // it could be that we implicitly added this node already because it was referenced
 	h.RUnlock()
 
 	if node == nil {
@@ -96,16 +146,15 @@ func (h *hnsw) insertFromExternal(nodeId, targetLevel int, neighborsAtLevel map[
 		h.currentMaximumLayer = 0
 		node.connections = map[int][]uint32{}
 		node.level = 0
-		h.nodes = make([]*hnswVertex, 100000)
 		h.commitLog.AddNode(node)
-		h.nodes[node.id] = node
+		h.nodes.set(node.id, node)
 		h.Unlock()
 		return
 	}
 
 	currentMaximumLayer := h.currentMaximumLayer
 	h.Lock()
-	h.nodes[nodeId] = node
+	h.nodes.set(nodeId, node)
 	h.commitLog.AddNode(node)
 	h.Unlock()
 
@@ -113,43 +162,23 @@ func (h *hnsw) insertFromExternal(nodeId, targetLevel int, neighborsAtLevel map[
 		neighbors := neighborsAtLevel[level]
 
 		for _, neighborID := range neighbors {
-			h.RLock()
-			neighbor := h.nodes[neighborID]
+			h.Lock()
+			neighbor := h.nodes.get(int(neighborID))
 			if neighbor == nil {
 				// due to everything being parallel it could be that the linked neighbor
 				// doesn't exist yet
-				h.nodes[neighborID] = &hnswVertex{
+				neighbor = &hnswVertex{
 					id:          int(neighborID),
 					connections: make(map[int][]uint32),
 				}
-				neighbor = h.nodes[neighborID]
+				h.nodes.set(int(neighborID), neighbor)
 			}
-			h.RUnlock()
+			h.Unlock()
 
 			neighbor.linkAtLevel(level, uint32(nodeId), h.commitLog)
 			node.linkAtLevel(level, uint32(neighbor.id), h.commitLog)
 
-			neighbor.RLock()
-			currentConnections := neighbor.connections[level]
-			neighbor.RUnlock()
-
-			maximumConnections := h.maximumConnections
-			if level == 0 {
-				maximumConnections = h.maximumConnectionsLayerZero
-			}
-
-			if len(currentConnections) <= maximumConnections {
-				// nothing to do, skip
-				continue
-			}
-
-			// TODO: support both neighbor selection algos
-			updatedConnections := h.selectNeighborsSimpleFromId(nodeId, currentConnections, maximumConnections)
-
-			neighbor.Lock()
-			h.commitLog.ReplaceLinksAtLevel(neighbor.id, level, updatedConnections)
-			neighbor.connections[level] = updatedConnections
-			neighbor.Unlock()
+			h.pruneConnections(neighbor, level)
 		}
 	}
 
@@ -167,33 +196,37 @@ func (h *hnsw) insert(node *hnswVertex) {
 	before := time.Now()
 	h.RLock()
 	m.addBuildingReadLockingBeginning(before)
-	total := len(h.nodes)
+	total := h.nodes.len()
+	exists := h.nodes.get(node.id) != nil
 	h.RUnlock()
 
-	if total == 0 {
-		h.Lock()
-		h.commitLog.SetEntryPointWithMaxLayer(node.id, 0)
-		h.entryPointID = node.id
-		h.currentMaximumLayer = 0
-		node.connections = map[int][]uint32{}
-		node.level = 0
-		h.nodes = make([]*hnswVertex, 100000)
-		h.commitLog.AddNode(node)
-		h.nodes[node.id] = node
-		h.Unlock()
+	if exists {
+		// simply overwriting the node would leave dangling links from its former
+		// neighbors. If the id was deleted before, it is alive again and must
+		// not be removed by the next cleanup.
+		h.removeTombstone(node.id)
+		if err := h.update(node.id); err != nil {
+			// removed by a tombstone cleanup in the meantime
+			h.insert(node)
+		}
+		return
+	}
 
-		go h.insertHook(node.id, 0, node.connections)
+	if total == 0 && h.insertFirst(node) {
+		if h.insertHook != nil {
+			go h.insertHook(node.id, 0, node.connections)
+		}
 		return
 	}
 	// initially use the "global" entrypoint which is guaranteed to be on the
-	// currently highest layer
+	// currently highest layer, and its level which is the highest level of the
+	// h-graph in the first iteration
+	h.RLock()
 	entryPointID := h.entryPointID
-
-	// initially use the level of the entrypoint which is the highest level of
-	// the h-graph in the first iteration
 	currentMaximumLayer := h.currentMaximumLayer
+	h.RUnlock()
 
-	targetLevel := int(math.Floor(-math.Log(rand.Float64()*h.levelNormalizer))) - 1
+	targetLevel := h.randomLevel()
 
 	before = time.Now()
 	node.Lock()
@@ -206,29 +239,42 @@ func (h *hnsw) insert(node *hnswVertex) {
 	h.Lock()
 	m.addBuildingLocking(before)
 	nodeId := node.id
-	h.nodes[nodeId] = node
+	h.nodes.set(nodeId, node)
 	h.commitLog.AddNode(node)
 	h.Unlock()
 
+	nodeVector := h.vectorForID(nodeId)
+	if h.compressor != nil {
+		h.compressor.encode(nodeId, nodeVector)
+	}
+	distToNode := h.distanceToQuery(nodeVector)
+
 	// in case the new target is lower than the current max, we need to search
 	// each layer for a better candidate and update the candidate
 	for level := currentMaximumLayer; level > targetLevel; level-- {
-		tmpBST := &binarySearchTreeGeneric{}
-		tmpBST.insert(entryPointID, h.distBetweenNodes(nodeId, entryPointID))
-		res := h.searchLayer(node, *tmpBST, 1, level)
-		entryPointID = res.minimum().index
+		eps := newMinPriorityQueue(1)
+		eps.insert(entryPointID, distToNode(entryPointID))
+		res := h.searchLayer(distToNode, eps, 1, level, nil, nil)
+		if res.len() > 0 {
+			entryPointID = res.top().id
+		}
 	}
 
-	var results = &binarySearchTreeGeneric{}
-	results.insert(entryPointID, h.distBetweenNodes(nodeId, entryPointID))
+	results := newMaxPriorityQueue(1)
+	results.insert(entryPointID, distToNode(entryPointID))
 
 	neighborsAtLevel := make(map[int][]uint32) // for distributed spike
 
 	for level := min(targetLevel, currentMaximumLayer); level >= 0; level-- {
-		results = h.searchLayer(node, *results, h.efConstruction, level)
+		res := h.searchLayer(distToNode, results, h.efConstruction, level, nil, nil)
+		if res.len() == 0 {
+			// everything we could reach on this level has been deleted, keep the
+			// previous entrypoints for the next level
+			continue
+		}
+		results = res
 
-		// TODO: support both neighbor selection algos
-		neighbors := h.selectNeighborsSimple(nodeId, *results, h.maximumConnections)
+		neighbors := h.selectNeighbors(nodeId, results.sorted(), h.maximumConnections, level)
 
 		// for distributed spike
 		neighborsAtLevel[level] = neighbors
@@ -237,109 +283,137 @@ func (h *hnsw) insert(node *hnswVertex) {
 			before := time.Now()
 			h.RLock()
 			m.addBuildingReadLocking(before)
-			neighbor := h.nodes[neighborID]
+			neighbor := h.nodes.get(int(neighborID))
 			h.RUnlock()
 
-			neighbor.linkAtLevel(level, uint32(nodeId), h.commitLog)
-			node.linkAtLevel(level, uint32(neighbor.id), h.commitLog)
-
-			before = time.Now()
-			neighbor.RLock()
-			m.addBuildingItemLocking(before)
-			currentConnections := neighbor.connections[level]
-			neighbor.RUnlock()
-
-			maximumConnections := h.maximumConnections
-			if level == 0 {
-				maximumConnections = h.maximumConnectionsLayerZero
-			}
-
-			if len(currentConnections) <= maximumConnections {
-				// nothing to do, skip
+			if neighbor == nil {
+				// removed by a tombstone cleanup in the meantime
 				continue
 			}
 
-			// TODO: support both neighbor selection algos
-			updatedConnections := h.selectNeighborsSimpleFromId(nodeId, currentConnections, maximumConnections)
+			neighbor.linkAtLevel(level, uint32(nodeId), h.commitLog)
+			node.linkAtLevel(level, uint32(neighbor.id), h.commitLog)
 
-			before = time.Now()
-			neighbor.Lock()
-			m.addBuildingItemLocking(before)
-			h.commitLog.ReplaceLinksAtLevel(neighbor.id, level, updatedConnections)
-			neighbor.connections[level] = updatedConnections
-			neighbor.Unlock()
+			h.pruneConnections(neighbor, level)
 		}
+
+		// concurrent inserts can link to the node while it selects its own
+		// neighbors
+		h.pruneConnections(node, level)
 	}
 
-	go h.insertHook(nodeId, targetLevel, neighborsAtLevel)
+	if h.insertHook != nil {
+		go h.insertHook(nodeId, targetLevel, neighborsAtLevel)
+	}
 
-	if targetLevel > h.currentMaximumLayer {
+	if targetLevel > currentMaximumLayer {
 		before = time.Now()
 		h.Lock()
 		m.addBuildingLocking(before)
-		h.commitLog.SetEntryPointWithMaxLayer(nodeId, targetLevel)
-		h.entryPointID = nodeId
-		h.currentMaximumLayer = targetLevel
+		// a concurrent insert could have raised the maximum in the meantime
+		if targetLevel > h.currentMaximumLayer {
+			h.commitLog.SetEntryPointWithMaxLayer(nodeId, targetLevel)
+			h.entryPointID = nodeId
+			h.currentMaximumLayer = targetLevel
+		}
 		h.Unlock()
 	}
 }
 
-func (h *hnsw) searchLayer(queryNode *hnswVertex, entrypoints binarySearchTreeGeneric, ef int, level int) *binarySearchTreeGeneric {
+// insertFirst makes node the entrypoint of an empty graph. It returns false
+// if a concurrent insert was faster and the graph is no longer empty.
+func (h *hnsw) insertFirst(node *hnswVertex) bool {
+	h.Lock()
+	defer h.Unlock()
 
-	// create 3 copies of the entrypoint bst
-	visited := map[uint32]struct{}{}
-	for _, elem := range entrypoints.flattenInOrder() {
-		visited[uint32(elem.index)] = struct{}{}
+	if h.nodes.len() != 0 {
+		return false
 	}
-	candidates := &binarySearchTreeGeneric{}
-	results := &binarySearchTreeGeneric{}
 
-	for _, ep := range entrypoints.flattenInOrder() {
-		candidates.insert(ep.index, ep.dist)
-		results.insert(ep.index, ep.dist)
+	h.commitLog.SetEntryPointWithMaxLayer(node.id, 0)
+	h.entryPointID = node.id
+	h.currentMaximumLayer = 0
+	node.connections = map[int][]uint32{}
+	node.level = 0
+	h.commitLog.AddNode(node)
+	h.nodes.set(node.id, node)
+	return true
+}
+
+// searchLayer finds the ef closest nodes to the query on the given level.
+// Only nodes which are contained in allow (if set) and not deleted are added
+// to the results, but every node is used for traversal.
+// The returned queue has the furthest result on top, entrypoints are not
+// modified. The search stops early once the budget is exceeded, the budget is
+// nil during construction.
+func (h *hnsw) searchLayer(distToQuery distanceToQuery, entrypoints *priorityQueue, ef int, level int,
+	allow allowList, budget *searchBudget) *priorityQueue {
+
+	h.RLock()
+	size := h.nodes.capacity()
+	h.RUnlock()
+
+	visited := h.visitedLists.borrow(size)
+	defer h.visitedLists.giveBack(visited)
+
+	candidates := newMinPriorityQueue(ef)
+	results := newMaxPriorityQueue(ef + 1) // +1 as we insert before removing the worst
+
+	for _, ep := range entrypoints.items {
+		visited.visit(uint32(ep.id))
+		candidates.insert(ep.id, ep.dist)
+		if h.isAllowedResult(ep.id, allow) {
+			results.insert(ep.id, ep.dist)
+		}
 	}
 
-	for candidates.root != nil { // efficient way to see if the len is > 0
-		candidate := candidates.minimum()
-		candidates.delete(candidate.index, candidate.dist)
-		worstResultDistance := h.distBetweenNodes(results.maximum().index, queryNode.id)
+	for expanded := 0; candidates.len() > 0; expanded++ {
+		if expanded%searchBudgetCheckInterval == 0 && budget.expired() {
+			break
+		}
 
-		if h.distBetweenNodes(candidate.index, queryNode.id) > worstResultDistance {
+		// with a filter, results only holds allowed nodes. Stopping before it is
+		// full would miss allowed nodes behind the next candidates.
+		candidate := candidates.pop()
+		if results.len() >= ef && candidate.dist > results.top().dist {
 			break
 		}
 
-		before := time.Now()
 		h.RLock()
-		m.addBuildingReadLocking(before)
-		candidateNode := h.nodes[candidate.index]
+		candidateNode := h.nodes.get(candidate.id)
 		h.RUnlock()
 
-		before = time.Now()
+		if candidateNode == nil {
+			// the node was removed by a tombstone cleanup in the meantime
+			continue
+		}
+
 		candidateNode.RLock()
-		m.addBuildingItemLocking(before)
 		connections := candidateNode.connections[level]
 		candidateNode.RUnlock()
 
 		for _, neighborID := range connections {
-			if _, ok := visited[neighborID]; ok {
+			if visited.visited(neighborID) {
 				// skip if we've already visited this neighbor
 				continue
 			}
 
 			// make sure we never visit this neighbor again
-			visited[neighborID] = struct{}{}
+			visited.visit(neighborID)
 
-			distance := h.distBetweenNodes(int(neighborID), queryNode.id)
-			resLenBefore := results.len() // calculating just once saves a bit of time
-			if distance < worstResultDistance || resLenBefore < ef {
-				results.insert(int(neighborID), distance)
+			distance := distToQuery(int(neighborID))
+			if results.len() < ef || distance < results.top().dist {
 				candidates.insert(int(neighborID), distance)
 
-				if resLenBefore+1 > ef { // +1 because we have added one node size calculating the len
-					max := results.maximum()
-					results.delete(max.index, max.dist)
+				if !h.isAllowedResult(int(neighborID), allow) {
+					// deleted or filtered nodes are still traversed, but never returned
+					continue
 				}
 
+				results.insert(int(neighborID), distance)
+				if results.len() > ef {
+					results.pop()
+				}
 			}
 
 		}
@@ -348,34 +422,105 @@ func (h *hnsw) searchLayer(queryNode *hnswVertex, entrypoints binarySearchTreeGe
 	return results
 }
 
-func (h *hnsw) selectNeighborsSimple(nodeId int, input binarySearchTreeGeneric, max int) []uint32 {
-	flat := input.flattenInOrder()
-	size := min(len(flat), max)
-	out := make([]uint32, size)
-	for i, elem := range flat {
-		if i >= size {
-			break
-		}
-		out[i] = uint32(elem.index)
+// isAllowedResult is false for nodes which were removed by a tombstone
+// cleanup, links to them can still be around if they were added concurrently
+func (h *hnsw) isAllowedResult(id int, allow allowList) bool {
+	if allow != nil && !allow.contains(id) {
+		return false
 	}
 
-	return out
+	h.RLock()
+	exists := h.nodes.get(id) != nil
+	h.RUnlock()
+
+	return exists && !h.hasTombstone(id)
 }
 
-func (h *hnsw) selectNeighborsSimpleFromId(nodeId int, ids []uint32, max int) []uint32 {
-	bst := &binarySearchTreeGeneric{}
-	for _, id := range ids {
-		dist := h.distBetweenNodes(int(id), nodeId)
-		bst.insert(int(id), dist)
+// selectNeighborsSimple expects input to be sorted by distance
+func (h *hnsw) selectNeighborsSimple(nodeId int, input []priorityQueueItem, max int) []uint32 {
+	out := make([]uint32, 0, min(len(input), max))
+	for _, elem := range input {
+		if len(out) >= max {
+			break
+		}
+
+		if elem.id == nodeId {
+			// never link a node to itself
+			continue
+		}
+
+		out = append(out, uint32(elem.id))
 	}
 
-	return h.selectNeighborsSimple(nodeId, *bst, max)
+	return out
 }
 
+// linkAtLevel does nothing if the link exists already. Two nodes which are
+// inserted concurrently can both select each other as neighbors.
 func (v *hnswVertex) linkAtLevel(level int, target uint32, cl *hnswCommitLogger) {
 	v.Lock()
+	defer v.Unlock()
+
+	if containsID(v.connections[level], target) {
+		return
+	}
+
 	cl.AddLinkAtLevel(v.id, level, target)
 	v.connections[level] = append(v.connections[level], target)
+}
+
+// pruneConnections selects the best connections of node at level once it has
+// more than allowed. The selection runs without holding the lock of node, so
+// it is repeated if a concurrent insert linked node in the meantime.
+func (h *hnsw) pruneConnections(node *hnswVertex, level int) {
+	maximumConnections := h.maximumConnections
+	if level == 0 {
+		maximumConnections = h.maximumConnectionsLayerZero
+	}
+
+	for {
+		node.RLock()
+		currentConnections := node.connections[level]
+		node.RUnlock()
+
+		if len(currentConnections) <= maximumConnections {
+			return
+		}
+
+		updatedConnections := h.selectNeighborsFromId(node.id, currentConnections, maximumConnections, level)
+
+		node.Lock()
+		if sameConnections(node.connections[level], currentConnections) {
+			h.commitLog.ReplaceLinksAtLevel(node.id, level, updatedConnections)
+			node.connections[level] = updatedConnections
+			node.Unlock()
+			return
+		}
+		node.Unlock()
+	}
+}
+
+// sameConnections reports whether latest is still the snapshot read earlier.
+// Links are only ever appended to or replaced as a whole, so the same length
+// and start mean that nothing changed.
+func sameConnections(latest, snapshot []uint32) bool {
+	if len(latest) != len(snapshot) {
+		return false
+	}
+
+	return len(latest) == 0 || &latest[0] == &snapshot[0]
+}
+
+func (v *hnswVertex) unlinkAtLevel(level int, target uint32, cl *hnswCommitLogger) {
+	v.Lock()
+	updated := make([]uint32, 0, len(v.connections[level]))
+	for _, id := range v.connections[level] {
+		if id != target {
+			updated = append(updated, id)
+		}
+	}
+	cl.ReplaceLinksAtLevel(v.id, level, updated)
+	v.connections[level] = updated
 	v.Unlock()
 }
 
@@ -393,42 +538,128 @@ func min(a, b int) int {
 	return b
 }
 
+// distBetweenNodes uses the compressed vectors if the graph is compressed
 func (h *hnsw) distBetweenNodes(a, b int) float32 {
-	return cosineDist(h.vectorForID(a), h.vectorForID(b))
+	if h.compressor != nil {
+		return h.compressor.distanceBetween(a, b)
+	}
+
+	return h.distancer.distance(h.vectorForID(a), h.vectorForID(b))
 }
 
-func (h *hnsw) knnSearch(queryNodeID int, k int, ef int) []int {
+// distanceToQuery calculates the distance between a node and a fixed query
+// vector
+type distanceToQuery func(id int) float32
+
+// distanceToQuery prepares everything that only depends on the query, such as
+// the lookup tables of a compressor, once for the whole search. Compressed
+// distances are approximations, see rescore.
+func (h *hnsw) distanceToQuery(queryVector []float32) distanceToQuery {
+	if h.compressor != nil {
+		return h.compressor.queryDistancer(queryVector)
+	}
+
+	return func(id int) float32 {
+		return h.distToVector(id, queryVector)
+	}
+}
+
+func (h *hnsw) distToVector(id int, vector []float32) float32 {
+	return h.distancer.distance(h.vectorForID(id), vector)
+}
+
+type searchResult struct {
+	id       int
+	distance float32
+}
+
+// knnSearch finds the k nearest neighbors of a node which is already part of
+// the index
+func (h *hnsw) knnSearch(queryNodeID int, k int, ef int, allow allowList) []searchResult {
+	return h.knnSearchByVector(h.vectorForID(queryNodeID), k, ef, allow)
+}
+
+// knnSearchByVector finds the k nearest neighbors of an arbitrary vector, the
+// vector does not need to be part of the index. If allow is set, only allowed
+// nodes are returned.
+func (h *hnsw) knnSearchByVector(queryVector []float32, k int, ef int, allow allowList) []searchResult {
+	return h.knnSearchByVectorWithBudget(queryVector, k, ef, allow, nil)
+}
+
+// knnSearchByVectorWithBudget returns the best results found so far once the
+// budget is exceeded, check budget.partial() to find out if that happened
+func (h *hnsw) knnSearchByVectorWithBudget(queryVector []float32, k int, ef int, allow allowList,
+	budget *searchBudget) []searchResult {
+	res, _ := h.countedKnnSearchByVector(queryVector, k, ef, allow, budget)
+	return res
+}
+
+// exactSearchCutoff is the number of allowed nodes up to which a filtered
+// search compares the query with every allowed node instead of traversing the
+// graph. The traversal only stops once it has found ef allowed nodes, with a
+// sparse filter it visits most of the graph on the way.
+const exactSearchCutoff = 1000
+
+// countedKnnSearchByVector also returns the number of distances calculated
+// for this search, including the rescoring. The count is local to the search,
+// so concurrent searches don't share a counter.
+func (h *hnsw) countedKnnSearchByVector(queryVector []float32, k int, ef int, allow allowList,
+	budget *searchBudget) ([]searchResult, int) {
+	queryVector = h.prepareQuery(queryVector)
+	if allow != nil && allow.len() <= max(ef, exactSearchCutoff) {
+		return h.countedExactSearchByVector(queryVector, k, allow, budget)
+	}
+
+	if h.compressor != nil {
+		ef = max(ef, k*h.compressor.oversampling())
+	}
+
 	h.RLock()
-	queryNode := h.nodes[queryNodeID]
+	total := h.nodes.len()
+	entryPointID := h.entryPointID
+	currentMaximumLayer := h.currentMaximumLayer
 	h.RUnlock()
 
-	entryPointID := h.entryPointID
-	entryPointDistance := h.distBetweenNodes(entryPointID, queryNodeID)
+	if total == 0 {
+		return nil, 0
+	}
+
+	var distances int
+	uncounted := h.distanceToQuery(queryVector)
+	distToQuery := func(id int) float32 {
+		distances++
+		return uncounted(id)
+	}
+	entryPointDistance := distToQuery(entryPointID)
 
-	for level := h.currentMaximumLayer; level >= 1; level-- { // stop at layer 1, not 0!
-		eps := &binarySearchTreeGeneric{}
+	for level := currentMaximumLayer; level >= 1; level-- { // stop at layer 1, not 0!
+		eps := newMinPriorityQueue(1)
 		eps.insert(entryPointID, entryPointDistance)
-		res := h.searchLayer(queryNode, *eps, 1, level)
-		best := res.minimum()
-		entryPointID = best.index
+		res := h.searchLayer(distToQuery, eps, 1, level, nil, budget)
+		if res.len() == 0 {
+			continue
+		}
+		best := res.top()
+		entryPointID = best.id
 		entryPointDistance = best.dist
 	}
 
-	eps := &binarySearchTreeGeneric{}
+	eps := newMinPriorityQueue(1)
 	eps.insert(entryPointID, entryPointDistance)
-	res := h.searchLayer(queryNode, *eps, ef, 0)
+	res := h.searchLayer(distToQuery, eps, ef, 0, allow, budget)
 
-	flat := res.flattenInOrder()
-	size := min(len(flat), k)
-	out := make([]int, size)
-	for i, elem := range flat {
-		if i >= size {
-			break
-		}
-		out[i] = elem.index
+	sorted := res.sorted()
+	if h.compressor != nil {
+		sorted = h.rescore(queryVector, sorted)
+		distances += len(sorted)
+	}
+	size := min(len(sorted), k)
+	out := make([]searchResult, size)
+	for i, elem := range sorted[:size] {
+		out[i] = searchResult{id: elem.id, distance: elem.dist}
 	}
 
-	return out
+	return out, distances
 }
 
 func (h *hnsw) Stats() {
@@ -436,14 +667,12 @@ func (h *hnsw) Stats() {
 
 	perLevelCount := map[int]uint{}
 
-	for _, node := range h.nodes {
-		if node == nil {
-			continue
-		}
+	h.nodes.forEach(func(node *hnswVertex) {
 		l := node.level
 		if l == 0 && len(node.connections) == 0 {
-			// filter out allocated space without nodes
-			continue
+			// filter out placeholders of the distributed spike which were never
+			// actually inserted
+			return
 		}
 		c, ok := perLevelCount[l]
 		if !ok {
@@ -451,10 +680,26 @@ func (h *hnsw) Stats() {
 		}
 
 		perLevelCount[l] = c + 1
-	}
+	})
 
 	for level, count := range perLevelCount {
 		fmt.Printf("unique count on level %d: %d\n", level, count)
 	}
 
 }
+
+// randomLevel draws the level of a new node from an exponentially decaying
+// distribution
+func (h *hnsw) randomLevel() int {
+	h.randomLock.Lock()
+	r := h.randomSource.Float64()
+	h.randomLock.Unlock()
+
+	return int(math.Floor(-math.Log(r) * h.levelNormalizer))
+}
+
+// prepareQuery brings an arbitrary query vector into the same form as the
+// vectors in the index
+func (h *hnsw) prepareQuery(queryVector []float32) []float32 {
+	return prepareQueryFor(h.distancer, queryVector)
+}
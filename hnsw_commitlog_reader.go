@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// replayCommitLogFile rebuilds the structure of a graph from a commit log
+// written by hnswCommitLogger, see replayCommitLog
+func replayCommitLogFile(path string, g *hnsw) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open commit log: %v", err)
+	}
+	defer f.Close()
+
+	return replayCommitLog(bufio.NewReader(f), g)
+}
+
+// replayCommitLog applies every event from r to g in the order in which they
+// were logged. Only the structure of the graph (nodes, links, entrypoint and
+// tombstones) is restored, g needs to be configured by the caller. A log
+// which ends in the middle of an event, for example because the process
+// crashed while writing, results in an error, but all complete events before
+// are applied.
+func replayCommitLog(r io.Reader, g *hnsw) error {
+	if g.tombstones == nil {
+		g.tombstones = map[int]struct{}{}
+	}
+
+	for offset := 0; ; offset++ {
+		var commitType hnswCommitType
+		err := binary.Read(r, binary.LittleEndian, &commitType)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read commit type of event %d: %v", offset, err)
+		}
+
+		if err := g.replayEvent(r, commitType); err != nil {
+			return fmt.Errorf("replay event %d: %v", offset, err)
+		}
+	}
+}
+
+func (g *hnsw) replayEvent(r io.Reader, commitType hnswCommitType) error {
+	switch commitType {
+	case addNode:
+		var event struct {
+			ID    uint32
+			Level uint16
+		}
+		if err := binary.Read(r, binary.LittleEndian, &event); err != nil {
+			return fmt.Errorf("read addNode: %v", err)
+		}
+
+		g.replayNode(int(event.ID)).level = int(event.Level)
+
+	case setEntryPointMaxLevel:
+		var event struct {
+			ID    uint32
+			Level uint16
+		}
+		if err := binary.Read(r, binary.LittleEndian, &event); err != nil {
+			return fmt.Errorf("read setEntryPointMaxLevel: %v", err)
+		}
+
+		g.entryPointID = int(event.ID)
+		g.currentMaximumLayer = int(event.Level)
+
+	case addLinkAtLevel:
+		var event struct {
+			ID     uint32
+			Level  uint16
+			Target uint32
+		}
+		if err := binary.Read(r, binary.LittleEndian, &event); err != nil {
+			return fmt.Errorf("read addLinkAtLevel: %v", err)
+		}
+
+		// links are unique, skipping existing ones makes replaying a log twice
+		// harmless
+		node := g.replayNode(int(event.ID))
+		level := int(event.Level)
+		if !containsID(node.connections[level], event.Target) {
+			node.connections[level] = append(node.connections[level], event.Target)
+		}
+
+	case replaceLinksAtLevel:
+		var event struct {
+			ID     uint32
+			Level  uint16
+			Length uint16
+		}
+		if err := binary.Read(r, binary.LittleEndian, &event); err != nil {
+			return fmt.Errorf("read replaceLinksAtLevel: %v", err)
+		}
+
+		targets := make([]uint32, event.Length)
+		if err := binary.Read(r, binary.LittleEndian, &targets); err != nil {
+			return fmt.Errorf("read replaceLinksAtLevel targets: %v", err)
+		}
+
+		g.replayNode(int(event.ID)).connections[int(event.Level)] = targets
+
+	case addTombstone, removeTombstone, deleteNode:
+		var id uint32
+		if err := binary.Read(r, binary.LittleEndian, &id); err != nil {
+			return fmt.Errorf("read node id: %v", err)
+		}
+
+		switch commitType {
+		case addTombstone:
+			g.tombstones[int(id)] = struct{}{}
+		case removeTombstone:
+			delete(g.tombstones, int(id))
+		case deleteNode:
+			g.nodes.set(int(id), nil)
+		}
+
+	default:
+		return fmt.Errorf("unknown commit type %d", commitType)
+	}
+
+	return nil
+}
+
+// replayNode returns the node with the given id and creates it if it does not
+// exist yet, nodes can be referenced by links before they are added
+func (g *hnsw) replayNode(id int) *hnswVertex {
+	node := g.nodes.get(id)
+	if node == nil {
+		node = &hnswVertex{id: id, connections: map[int][]uint32{}}
+		g.nodes.set(id, node)
+	}
+
+	return node
+}
@@ -8,12 +8,21 @@ import (
 	"os"
 )
 
-func newHnswCommitLogger() *hnswCommitLogger {
+// commitLogPathFor gives every index its own log, so that replaying a log
+// never merges several graphs
+func commitLogPathFor(indexID string) string {
+	return commitLogPath + "_" + indexID
+}
+
+// newHnswCommitLogger starts a new log, replacing the log of a previous graph
+// with the same id. A graph loaded from disk replays its log before, see
+// main.
+func newHnswCommitLogger(path string) *hnswCommitLogger {
 	l := &hnswCommitLogger{
 		events: make(chan []byte),
 	}
 
-	fd, err := os.OpenFile("./data/hnsw_commit_log", os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
 		panic(err)
 	}
@@ -26,6 +35,7 @@ func newHnswCommitLogger() *hnswCommitLogger {
 type hnswCommitLogger struct {
 	events  chan []byte
 	logFile *os.File
+	done    chan struct{}
 }
 
 type hnswCommitType uint8 // 256 options, plenty of room for future extensions
@@ -35,6 +45,9 @@ const (
 	setEntryPointMaxLevel
 	addLinkAtLevel
 	replaceLinksAtLevel
+	addTombstone
+	removeTombstone
+	deleteNode
 )
 
 // AddNode adds an empty node
@@ -63,6 +76,7 @@ func (l *hnswCommitLogger) SetEntryPointWithMaxLayer(id int, level int) error {
 func (l *hnswCommitLogger) AddLinkAtLevel(nodeid int, level int, target uint32) error {
 	w := &bytes.Buffer{}
 	l.writeCommitType(w, addLinkAtLevel)
+	l.writeUint32(w, uint32(nodeid))
 	l.writeUint16(w, uint16(level))
 	l.writeUint32(w, target)
 
@@ -82,15 +96,64 @@ func (l *hnswCommitLogger) ReplaceLinksAtLevel(nodeid int, level int, targets []
 	return nil
 }
 
+func (l *hnswCommitLogger) AddTombstone(nodeid int) error {
+	w := &bytes.Buffer{}
+	l.writeCommitType(w, addTombstone)
+	l.writeUint32(w, uint32(nodeid))
+
+	l.events <- w.Bytes()
+	return nil
+}
+
+func (l *hnswCommitLogger) RemoveTombstone(nodeid int) error {
+	w := &bytes.Buffer{}
+	l.writeCommitType(w, removeTombstone)
+	l.writeUint32(w, uint32(nodeid))
+
+	l.events <- w.Bytes()
+	return nil
+}
+
+func (l *hnswCommitLogger) DeleteNode(nodeid int) error {
+	w := &bytes.Buffer{}
+	l.writeCommitType(w, deleteNode)
+	l.writeUint32(w, uint32(nodeid))
+
+	l.events <- w.Bytes()
+	return nil
+}
+
+// Truncate drops the events logged so far, once they are part of the index
+// file. Events logged afterwards are kept.
+func (l *hnswCommitLogger) Truncate() {
+	// no event is empty, so nil can't be mistaken for one
+	l.events <- nil
+}
+
 func (l *hnswCommitLogger) StartLogging() {
+	l.done = make(chan struct{})
 	go func() {
-		for {
-			event := <-l.events
+		defer close(l.done)
+		for event := range l.events {
+			if event == nil {
+				l.logFile.Truncate(0)
+				l.logFile.Seek(0, io.SeekStart)
+				continue
+			}
+
 			l.logFile.Write(event)
 		}
 	}()
 }
 
+// Close writes all pending events and closes the log file, the logger must
+// not be used afterwards
+func (l *hnswCommitLogger) Close() error {
+	close(l.events)
+	<-l.done
+	return l.logFile.Close()
+}
+
 func (l *hnswCommitLogger) writeUint32(w io.Writer, in uint32) error {
 	err := binary.Write(w, binary.LittleEndian, &in)
 	if err != nil {
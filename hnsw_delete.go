@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// delete marks a node as deleted. The node is not removed from the graph
+// immediately, it is still traversed during searches (so that the graph stays
+// navigable), but it is never returned as a result. The actual removal
+// happens in cleanUpTombstones
+func (h *hnsw) delete(id int) error {
+	h.RLock()
+	exists := h.nodes.get(id) != nil
+	h.RUnlock()
+
+	if !exists {
+		return fmt.Errorf("node %d does not exist", id)
+	}
+
+	h.tombstoneLock.Lock()
+	h.tombstones[id] = struct{}{}
+	h.tombstoneLock.Unlock()
+	h.commitLog.AddTombstone(id)
+
+	return nil
+}
+
+// removeTombstone undoes a delete which was not cleaned up yet
+func (h *hnsw) removeTombstone(id int) {
+	h.tombstoneLock.Lock()
+	defer h.tombstoneLock.Unlock()
+
+	if _, ok := h.tombstones[id]; !ok {
+		return
+	}
+
+	delete(h.tombstones, id)
+	h.commitLog.RemoveTombstone(id)
+}
+
+func (h *hnsw) hasTombstone(id int) bool {
+	h.tombstoneLock.RLock()
+	_, ok := h.tombstones[id]
+	h.tombstoneLock.RUnlock()
+	return ok
+}
+
+// startTombstoneCleanup periodically removes deleted nodes from the graph
+func (h *hnsw) startTombstoneCleanup(interval time.Duration) {
+	go func() {
+		t := time.NewTicker(interval)
+		for range t.C {
+			if err := h.cleanUpTombstones(); err != nil {
+				log.Printf("tombstone cleanup of %s: %v", h.id, err)
+			}
+		}
+	}()
+}
+
+// cleanUpTombstones removes all nodes marked as deleted from the graph. Every
+// node which was connected to a deleted node is reconnected using the
+// neighbors of the deleted node as additional candidates. If the entrypoint
+// itself was deleted, a new one is chosen.
+func (h *hnsw) cleanUpTombstones() error {
+	h.tombstoneLock.RLock()
+	deleted := make(map[int]struct{}, len(h.tombstones))
+	for id := range h.tombstones {
+		deleted[id] = struct{}{}
+	}
+	h.tombstoneLock.RUnlock()
+
+	if len(deleted) == 0 {
+		return nil
+	}
+
+	h.RLock()
+	nodes := h.nodes.snapshot()
+	h.RUnlock()
+
+	nodes.forEach(func(node *hnswVertex) {
+		if _, ok := deleted[node.id]; ok {
+			return
+		}
+
+		h.reassignNeighborsOf(node, deleted)
+	})
+
+	h.Lock()
+	for id := range deleted {
+		if !h.hasTombstone(id) {
+			// inserted again while the neighbors were reassigned
+			delete(deleted, id)
+			continue
+		}
+
+		h.nodes.set(id, nil)
+		h.commitLog.DeleteNode(id)
+		if h.compressor != nil {
+			h.compressor.delete(id)
+		}
+	}
+
+	if _, ok := deleted[h.entryPointID]; ok {
+		h.replaceEntryPoint(deleted)
+	}
+	h.Unlock()
+
+	h.tombstoneLock.Lock()
+	for id := range deleted {
+		delete(h.tombstones, id)
+		h.commitLog.RemoveTombstone(id)
+	}
+	h.tombstoneLock.Unlock()
+
+	return nil
+}
+
+// reassignNeighborsOf replaces every deleted neighbor of node. The remaining
+// neighbors as well as the neighbors of the deleted nodes are candidates for
+// the new connections.
+func (h *hnsw) reassignNeighborsOf(node *hnswVertex, deleted map[int]struct{}) {
+	node.RLock()
+	levels := make([]int, 0, len(node.connections))
+	for level := range node.connections {
+		levels = append(levels, level)
+	}
+	node.RUnlock()
+
+	for _, level := range levels {
+		h.reassignNeighborsAtLevel(node, level, deleted)
+	}
+}
+
+// reassignNeighborsAtLevel selects the new connections without holding the
+// lock of node, like pruneConnections it starts over if a concurrent insert
+// linked node in the meantime
+func (h *hnsw) reassignNeighborsAtLevel(node *hnswVertex, level int, deleted map[int]struct{}) {
+	maximumConnections := h.maximumConnections
+	if level == 0 {
+		maximumConnections = h.maximumConnectionsLayerZero
+	}
+
+	for {
+		node.RLock()
+		connections := node.connections[level]
+		node.RUnlock()
+
+		if !containsAnyOf(connections, deleted) {
+			return
+		}
+
+		candidates := h.replacementCandidates(node.id, connections, level, deleted)
+		updatedConnections := h.selectNeighborsFromId(node.id, candidates, maximumConnections, level)
+
+		node.Lock()
+		if sameConnections(node.connections[level], connections) {
+			h.commitLog.ReplaceLinksAtLevel(node.id, level, updatedConnections)
+			node.connections[level] = updatedConnections
+			node.Unlock()
+			return
+		}
+		node.Unlock()
+	}
+}
+
+// replacementCandidates are the connections which are not deleted, plus the
+// connections of the deleted ones
+func (h *hnsw) replacementCandidates(nodeID int, connections []uint32, level int,
+	deleted map[int]struct{}) []uint32 {
+	candidates := map[uint32]struct{}{}
+	for _, id := range connections {
+		if _, ok := deleted[int(id)]; !ok {
+			candidates[id] = struct{}{}
+			continue
+		}
+
+		h.RLock()
+		deletedNode := h.nodes.get(int(id))
+		h.RUnlock()
+
+		if deletedNode == nil {
+			continue
+		}
+
+		deletedNode.RLock()
+		for _, candidateID := range deletedNode.connections[level] {
+			if _, ok := deleted[int(candidateID)]; ok || int(candidateID) == nodeID {
+				continue
+			}
+			candidates[candidateID] = struct{}{}
+		}
+		deletedNode.RUnlock()
+	}
+
+	out := make([]uint32, 0, len(candidates))
+	for id := range candidates {
+		out = append(out, id)
+	}
+
+	return out
+}
+
+// replaceEntryPoint picks the highest node which is not deleted as the new
+// entrypoint. h must be locked by the caller.
+func (h *hnsw) replaceEntryPoint(deleted map[int]struct{}) {
+	found := false
+	var newEntryPoint *hnswVertex
+	h.nodes.forEach(func(node *hnswVertex) {
+		if _, ok := deleted[node.id]; ok {
+			return
+		}
+
+		if !found || node.level > newEntryPoint.level {
+			newEntryPoint = node
+			found = true
+		}
+	})
+
+	if !found {
+		// every single node was deleted, the next insert starts a new graph
+		h.entryPointID = 0
+		h.currentMaximumLayer = 0
+		return
+	}
+
+	h.commitLog.SetEntryPointWithMaxLayer(newEntryPoint.id, newEntryPoint.level)
+	h.entryPointID = newEntryPoint.id
+	h.currentMaximumLayer = newEntryPoint.level
+}
+
+func containsAnyOf(ids []uint32, set map[int]struct{}) bool {
+	for _, id := range ids {
+		if _, ok := set[int(id)]; ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -5,6 +5,11 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"time"
 )
 
 func (h *hnsw) MarshalGzip() ([]byte, error) {
@@ -18,22 +23,47 @@ func (h *hnsw) MarshalGzip() ([]byte, error) {
 	ec.add(h.writeAsInt64(b, h.efConstruction))
 	ec.add(h.writeFloat64(b, h.levelNormalizer))
 
-	ec.add(h.writeAsInt64(b, len(h.nodes)))
-	for _, node := range h.nodes {
-		if node == nil {
-			// in case we grew further than what we actually need
-			continue
-		}
+	ec.add(h.writeAsInt64(b, h.nodes.len()))
+	h.nodes.forEach(func(node *hnswVertex) {
 		ec.add(h.writeAsInt64(b, node.id))
 		ec.add(h.writeAsInt64(b, node.level))
 		connectionLevels := len(node.connections)
 		ec.add(h.writeAsInt64(b, connectionLevels))
-		for level, conns := range node.connections {
+
+		// sorted, so that identical graphs lead to identical bytes
+		levels := make([]int, 0, connectionLevels)
+		for level := range node.connections {
+			levels = append(levels, level)
+		}
+		sort.Ints(levels)
+
+		for _, level := range levels {
+			conns := node.connections[level]
 			ec.add(h.writeAsInt64(b, level))
 			connectionsLength := len(conns)
 			ec.add(h.writeAsInt64(b, connectionsLength))
 			ec.add(h.writeUint32Slice(b, conns))
 		}
+	})
+
+	// appended after the nodes, so that indexes written before the metric was
+	// configurable can still be read
+	ec.add(h.writeUint8(b, uint8(h.distancer.metric())))
+	ec.add(h.writeUint8(b, uint8(h.neighborSelection.algorithm)))
+	ec.add(h.writeUint8(b, h.neighborSelection.flags()))
+
+	// sorted, so that identical graphs lead to identical bytes
+	h.tombstoneLock.RLock()
+	tombstones := make([]int, 0, len(h.tombstones))
+	for id := range h.tombstones {
+		tombstones = append(tombstones, id)
+	}
+	h.tombstoneLock.RUnlock()
+	sort.Ints(tombstones)
+
+	ec.add(h.writeAsInt64(b, len(tombstones)))
+	for _, id := range tombstones {
+		ec.add(h.writeAsInt64(b, id))
 	}
 
 	if len(ec.errors) != 0 {
@@ -43,6 +73,26 @@ func (h *hnsw) MarshalGzip() ([]byte, error) {
 	return b.Bytes(), nil
 }
 
+// writeIndexFile replaces the index file at path with g. It writes to a
+// temporary file first, so that a crash never leaves a partial index behind.
+func writeIndexFile(g *hnsw, path string) error {
+	bytes, err := g.MarshalGzip()
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, bytes, 0666); err != nil {
+		return fmt.Errorf("write index: %v", err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("replace index: %v", err)
+	}
+
+	return nil
+}
+
 func (h *hnsw) writeAsInt64(w io.Writer, in int) error {
 	typed := int64(in)
 	err := binary.Write(w, binary.LittleEndian, &typed)
@@ -62,6 +112,15 @@ func (h *hnsw) writeFloat64(w io.Writer, in float64) error {
 	return nil
 }
 
+func (h *hnsw) writeUint8(w io.Writer, in uint8) error {
+	err := binary.Write(w, binary.LittleEndian, &in)
+	if err != nil {
+		return fmt.Errorf("writing uint8: %v", err)
+	}
+
+	return nil
+}
+
 func (h *hnsw) writeUint32Slice(w io.Writer, in []uint32) error {
 	err := binary.Write(w, binary.LittleEndian, &in)
 	if err != nil {
@@ -92,8 +151,17 @@ func UnmarshalGzip(in []byte, g *hnsw) error {
 	lenNodes, err := g.readFromInt64(b)
 	ec.add(err)
 
-	g.nodes = make([]*hnswVertex, lenNodes)
-	for i := range g.nodes {
+	g.tombstones = map[int]struct{}{}
+	g.visitedLists = newVisitedListPool()
+	g.randomSource = rand.New(rand.NewSource(time.Now().UnixNano()))
+	g.nodes = hnswNodes{}
+	for i := 0; i < lenNodes; i++ {
+		if b.Len() == 0 {
+			// older indexes announced the full capacity of the node slice, but
+			// only contained the nodes which were actually set
+			break
+		}
+
 		node := hnswVertex{}
 		node.id, err = g.readFromInt64(b)
 		ec.add(err)
@@ -118,7 +186,43 @@ func UnmarshalGzip(in []byte, g *hnsw) error {
 			node.connections[level] = connections
 		}
 
-		g.nodes[i] = &node
+		g.nodes.set(node.id, &node)
+	}
+
+	metric := metricCosine
+	if b.Len() > 0 {
+		metricByte, err := g.readUint8(b)
+		ec.add(err)
+		metric = distanceMetric(metricByte)
+	}
+
+	g.distancer, err = newDistanceProvider(metric)
+	ec.add(err)
+
+	// indexes written before the selection was stored were built with the
+	// simple selection, which is the zero value
+	g.neighborSelection = neighborSelection{}
+	if b.Len() > 0 {
+		algorithm, err := g.readUint8(b)
+		ec.add(err)
+		flags, err := g.readUint8(b)
+		ec.add(err)
+		g.neighborSelection = neighborSelectionFromFlags(neighborSelectionAlgorithm(algorithm), flags)
+	}
+
+	// nodes which were deleted, but not yet removed from the graph
+	if b.Len() > 0 {
+		lenTombstones, err := g.readFromInt64(b)
+		ec.add(err)
+		for i := 0; i < lenTombstones; i++ {
+			id, err := g.readFromInt64(b)
+			ec.add(err)
+			g.tombstones[id] = struct{}{}
+		}
+	}
+
+	if len(ec.errors) != 0 {
+		return fmt.Errorf("%v", ec.errors)
 	}
 
 	return nil
@@ -144,6 +248,16 @@ func (h *hnsw) readFloat64(r io.Reader) (float64, error) {
 	return value, nil
 }
 
+func (h *hnsw) readUint8(r io.Reader) (uint8, error) {
+	var value uint8
+	err := binary.Read(r, binary.LittleEndian, &value)
+	if err != nil {
+		return 0, fmt.Errorf("reading uint8: %v", err)
+	}
+
+	return value, nil
+}
+
 func (h *hnsw) readUint32Slice(r io.Reader, length int) ([]uint32, error) {
 	value := make([]uint32, length)
 	err := binary.Read(r, binary.LittleEndian, &value)
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMarshalling(t *testing.T) {
+	vectors := randomVectors(rand.New(rand.NewSource(7)), 200, 16)
+	cfg := testConfig()
+	cfg.distancer = squaredL2Distancer{}
+	h := buildTestGraph(t, vectors, cfg)
+
+	bytes, err := h.MarshalGzip()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := &hnsw{}
+	if err := UnmarshalGzip(bytes, restored); err != nil {
+		t.Fatal(err)
+	}
+
+	if restored.distancer.metric() != metricSquaredL2 {
+		t.Errorf("expected metric to be restored, got %s", restored.distancer.metric())
+	}
+
+	if restored.neighborSelection != h.neighborSelection {
+		t.Errorf("expected neighbor selection %+v to be restored, got %+v", h.neighborSelection,
+			restored.neighborSelection)
+	}
+
+	if restored.entryPointID != h.entryPointID || restored.currentMaximumLayer != h.currentMaximumLayer {
+		t.Errorf("expected entrypoint %d on layer %d, got %d on layer %d", h.entryPointID,
+			h.currentMaximumLayer, restored.entryPointID, restored.currentMaximumLayer)
+	}
+
+	if restored.nodes.len() != len(vectors) {
+		t.Fatalf("expected %d nodes, got %d", len(vectors), restored.nodes.len())
+	}
+
+	for i := range vectors {
+		if !reflect.DeepEqual(h.nodes.get(i).connections, restored.nodes.get(i).connections) {
+			t.Errorf("connections of node %d differ", i)
+		}
+	}
+}
+
+func TestReproducibleBuild(t *testing.T) {
+	vectors := randomVectors(rand.New(rand.NewSource(7)), 300, 16)
+	build := func(seed int64) []byte {
+		cfg := testConfig()
+		cfg.randomSeed = seed
+		h := buildTestGraph(t, vectors, cfg)
+
+		out, err := h.MarshalGzip()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return out
+	}
+
+	if !bytes.Equal(build(42), build(42)) {
+		t.Errorf("expected two builds with the same seed to be identical")
+	}
+
+	if bytes.Equal(build(42), build(43)) {
+		t.Errorf("expected builds with different seeds to differ")
+	}
+}
+
+// deletes and updates made after the index file was written only reach the
+// commit log, a restart has to restore them from there
+func TestRestoreChangesFromCommitLog(t *testing.T) {
+	vectors := randomVectors(rand.New(rand.NewSource(7)), 300, 16)
+	cfg := testConfig()
+	h := buildTestGraph(t, vectors, cfg)
+
+	snapshot, err := h.MarshalGzip()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "hnsw_restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logPath := filepath.Join(dir, "commit.log")
+	h.commitLog = newHnswCommitLogger(logPath)
+
+	deleted := []int{0, 3, 17, 42, 99, 150}
+	for _, id := range deleted {
+		if err := h.delete(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := h.cleanUpTombstones(); err != nil {
+		t.Fatal(err)
+	}
+
+	// deleted after the cleanup, so they are still tombstoned
+	for _, id := range []int{200, h.entryPointID} {
+		if err := h.delete(id); err != nil {
+			t.Fatal(err)
+		}
+		deleted = append(deleted, id)
+	}
+
+	vectors[250] = vectors[1]
+	if err := h.update(250); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.commitLog.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newTestHnsw(t, cfg, func(id int) []float32 { return vectors[id] })
+	if err := UnmarshalGzip(snapshot, restored); err != nil {
+		t.Fatal(err)
+	}
+	if err := replayCommitLogFile(logPath, restored); err != nil {
+		t.Fatal(err)
+	}
+
+	// once replayed, the changes are part of the next index file
+	bytes, err := restored.MarshalGzip()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored = newTestHnsw(t, cfg, func(id int) []float32 { return vectors[id] })
+	if err := UnmarshalGzip(bytes, restored); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(h.tombstones, restored.tombstones) {
+		t.Errorf("expected tombstones %v, got %v", h.tombstones, restored.tombstones)
+	}
+
+	if restored.entryPointID != h.entryPointID || restored.currentMaximumLayer != h.currentMaximumLayer {
+		t.Errorf("expected entrypoint %d on layer %d, got %d on layer %d", h.entryPointID,
+			h.currentMaximumLayer, restored.entryPointID, restored.currentMaximumLayer)
+	}
+
+	for i := range vectors {
+		node, restoredNode := h.nodes.get(i), restored.nodes.get(i)
+		if (node == nil) != (restoredNode == nil) {
+			t.Fatalf("expected node %d to exist: %t, got %t", i, node != nil, restoredNode != nil)
+		}
+
+		if node != nil && !reflect.DeepEqual(node.connections, restoredNode.connections) {
+			t.Errorf("connections of node %d differ", i)
+		}
+	}
+
+	for _, id := range deleted {
+		for _, res := range restored.knnSearchByVectorWithBudget(vectors[id], 10, 64, nil, nil) {
+			if res.id == id {
+				t.Errorf("expected deleted node %d not to be found", id)
+			}
+		}
+	}
+
+	results := restored.knnSearchByVectorWithBudget(vectors[1], 2, 64, nil, nil)
+	if len(results) != 2 || !containsInt([]int{results[0].id, results[1].id}, 250) {
+		t.Errorf("expected the updated node 250 to be found at its new position, got %v", results)
+	}
+}
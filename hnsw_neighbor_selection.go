@@ -0,0 +1,169 @@
+package main
+
+import "sort"
+
+type neighborSelectionAlgorithm int
+
+const (
+	// neighborSelectionSimple simply picks the closest candidates (Algorithm 3
+	// in the paper)
+	neighborSelectionSimple neighborSelectionAlgorithm = iota
+
+	// neighborSelectionHeuristic only keeps a candidate if it is closer to the
+	// base node than to any of the already selected neighbors (Algorithm 4 in
+	// the paper). This favors connections in diverse directions and avoids
+	// isolated cliques on clustered data
+	neighborSelectionHeuristic
+)
+
+type neighborSelection struct {
+	algorithm neighborSelectionAlgorithm
+
+	// only used by the heuristic: also consider the neighbors of each
+	// candidate, useful for extremely clustered data
+	extendCandidates bool
+
+	// only used by the heuristic: fill up the remaining slots with the closest
+	// of the discarded candidates, so that nodes keep a fixed number of
+	// connections
+	keepPrunedConnections bool
+}
+
+const (
+	selectionExtendCandidates uint8 = 1 << iota
+	selectionKeepPrunedConnections
+)
+
+// flags packs the options of the heuristic into a single byte for the index
+// file
+func (s neighborSelection) flags() uint8 {
+	var out uint8
+	if s.extendCandidates {
+		out |= selectionExtendCandidates
+	}
+	if s.keepPrunedConnections {
+		out |= selectionKeepPrunedConnections
+	}
+
+	return out
+}
+
+func neighborSelectionFromFlags(algorithm neighborSelectionAlgorithm, flags uint8) neighborSelection {
+	return neighborSelection{
+		algorithm:             algorithm,
+		extendCandidates:      flags&selectionExtendCandidates != 0,
+		keepPrunedConnections: flags&selectionKeepPrunedConnections != 0,
+	}
+}
+
+// selectNeighbors picks at most max neighbors for nodeId out of input (which
+// contains the distances to nodeId sorted from closest to furthest) using the
+// algorithm configured for this index
+func (h *hnsw) selectNeighbors(nodeId int, input []priorityQueueItem, max int, level int) []uint32 {
+	if h.neighborSelection.algorithm == neighborSelectionHeuristic {
+		return h.selectNeighborsHeuristic(nodeId, input, max, level)
+	}
+
+	return h.selectNeighborsSimple(nodeId, input, max)
+}
+
+func (h *hnsw) selectNeighborsFromId(nodeId int, ids []uint32, max int, level int) []uint32 {
+	input := make([]priorityQueueItem, len(ids))
+	for i, id := range ids {
+		input[i] = priorityQueueItem{id: int(id), dist: h.distBetweenNodes(int(id), nodeId)}
+	}
+	sortByDistance(input)
+
+	return h.selectNeighbors(nodeId, input, max, level)
+}
+
+func (h *hnsw) selectNeighborsHeuristic(nodeId int, input []priorityQueueItem, max int, level int) []uint32 {
+	candidates := make([]priorityQueueItem, 0, len(input))
+	seen := map[int]struct{}{nodeId: struct{}{}}
+	for _, elem := range input {
+		if _, ok := seen[elem.id]; ok {
+			continue
+		}
+
+		seen[elem.id] = struct{}{}
+		candidates = append(candidates, elem)
+	}
+
+	if h.neighborSelection.extendCandidates {
+		for _, elem := range input {
+			h.RLock()
+			candidateNode := h.nodes.get(elem.id)
+			h.RUnlock()
+
+			if candidateNode == nil {
+				continue
+			}
+
+			candidateNode.RLock()
+			connections := candidateNode.connections[level]
+			candidateNode.RUnlock()
+
+			for _, neighborID := range connections {
+				if _, ok := seen[int(neighborID)]; ok {
+					continue
+				}
+
+				if h.hasTombstone(int(neighborID)) {
+					continue
+				}
+
+				seen[int(neighborID)] = struct{}{}
+				candidates = append(candidates, priorityQueueItem{
+					id:   int(neighborID),
+					dist: h.distBetweenNodes(int(neighborID), nodeId),
+				})
+			}
+		}
+
+		sortByDistance(candidates)
+	}
+
+	out := make([]uint32, 0, max)
+	var discarded []priorityQueueItem
+
+	// iterating in order is the same as repeatedly extracting the closest
+	// candidate
+	for _, candidate := range candidates {
+		if len(out) >= max {
+			break
+		}
+
+		good := true
+		for _, selectedID := range out {
+			if h.distBetweenNodes(candidate.id, int(selectedID)) < candidate.dist {
+				// the candidate is closer to an existing neighbor than to the base
+				// node, so the base node is already reachable through that neighbor
+				good = false
+				break
+			}
+		}
+
+		if good {
+			out = append(out, uint32(candidate.id))
+		} else {
+			discarded = append(discarded, candidate)
+		}
+	}
+
+	if h.neighborSelection.keepPrunedConnections {
+		// discarded is already sorted by distance
+		for _, candidate := range discarded {
+			if len(out) >= max {
+				break
+			}
+
+			out = append(out, uint32(candidate.id))
+		}
+	}
+
+	return out
+}
+
+func sortByDistance(items []priorityQueueItem) {
+	sort.Slice(items, func(a, b int) bool { return items[a].dist < items[b].dist })
+}
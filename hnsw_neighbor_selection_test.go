@@ -0,0 +1,63 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func vectorAtAngle(degrees float64) []float32 {
+	rad := degrees * math.Pi / 180
+	return []float32{float32(math.Cos(rad)), float32(math.Sin(rad))}
+}
+
+func TestSelectNeighbors(t *testing.T) {
+	m = newMonitoring()
+
+	vectors := [][]float32{
+		vectorAtAngle(0),   // the base node
+		vectorAtAngle(10),  // a tight cluster on one side
+		vectorAtAngle(11),  //
+		vectorAtAngle(12),  //
+		vectorAtAngle(-40), // further away, but in a different direction
+	}
+	vectorForID := func(id int) []float32 { return vectors[id] }
+	candidates := []uint32{1, 2, 3, 4}
+
+	t.Run("simple", func(t *testing.T) {
+		h := newTestHnswWithoutLog(neighborSelection{algorithm: neighborSelectionSimple}, vectorForID)
+		res := h.selectNeighborsFromId(0, candidates, 2, 0)
+		if !reflect.DeepEqual(res, []uint32{1, 2}) {
+			t.Errorf("expected closest two neighbors, got %v", res)
+		}
+	})
+
+	t.Run("heuristic", func(t *testing.T) {
+		h := newTestHnswWithoutLog(neighborSelection{algorithm: neighborSelectionHeuristic}, vectorForID)
+		res := h.selectNeighborsFromId(0, candidates, 2, 0)
+		if !reflect.DeepEqual(res, []uint32{1, 4}) {
+			t.Errorf("expected one neighbor per direction, got %v", res)
+		}
+	})
+
+	t.Run("heuristic keeping pruned connections", func(t *testing.T) {
+		h := newTestHnswWithoutLog(neighborSelection{
+			algorithm:             neighborSelectionHeuristic,
+			keepPrunedConnections: true,
+		}, vectorForID)
+		res := h.selectNeighborsFromId(0, candidates, 3, 0)
+		if !reflect.DeepEqual(res, []uint32{1, 4, 2}) {
+			t.Errorf("expected pruned neighbors to fill up remaining slots, got %v", res)
+		}
+	})
+}
+
+func newTestHnswWithoutLog(selection neighborSelection, vectorForID func(int) []float32) *hnsw {
+	return &hnsw{
+		maximumConnections:          2,
+		maximumConnectionsLayerZero: 4,
+		neighborSelection:           selection,
+		distancer:                   cosineDistancer{},
+		vectorForID:                 vectorForID,
+	}
+}
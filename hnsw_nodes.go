@@ -0,0 +1,72 @@
+package main
+
+// nodesChunkSize is the number of vertex pointers allocated at once
+const nodesChunkSize = 1 << 16
+
+// hnswNodes holds the vertices of a graph indexed by their id. It grows in
+// fixed-size chunks, so growing never copies existing vertex pointers, only
+// the (much shorter) list of chunks. hnswNodes does no locking on its own:
+// reads must hold the read lock of the graph, set must hold the write lock.
+type hnswNodes struct {
+	chunks [][]*hnswVertex
+
+	// number of non-nil vertices
+	count int
+}
+
+func (n *hnswNodes) get(id int) *hnswVertex {
+	chunk := id / nodesChunkSize
+	if id < 0 || chunk >= len(n.chunks) {
+		return nil
+	}
+
+	return n.chunks[chunk][id%nodesChunkSize]
+}
+
+// set stores the vertex at position id, growing the storage if required.
+// Setting nil removes the vertex.
+func (n *hnswNodes) set(id int, v *hnswVertex) {
+	chunk := id / nodesChunkSize
+	for chunk >= len(n.chunks) {
+		n.chunks = append(n.chunks, make([]*hnswVertex, nodesChunkSize))
+	}
+
+	previous := n.chunks[chunk][id%nodesChunkSize]
+	if previous == nil && v != nil {
+		n.count++
+	} else if previous != nil && v == nil {
+		n.count--
+	}
+
+	n.chunks[chunk][id%nodesChunkSize] = v
+}
+
+// len is the number of vertices actually present
+func (n *hnswNodes) len() int {
+	return n.count
+}
+
+// capacity is the number of ids which can be addressed without growing
+func (n *hnswNodes) capacity() int {
+	return len(n.chunks) * nodesChunkSize
+}
+
+// snapshot returns a copy of the list of chunks which can be iterated without
+// holding the graph lock. Vertices added in a new chunk afterwards are not
+// part of the snapshot.
+func (n *hnswNodes) snapshot() *hnswNodes {
+	chunks := make([][]*hnswVertex, len(n.chunks))
+	copy(chunks, n.chunks)
+	return &hnswNodes{chunks: chunks, count: n.count}
+}
+
+// forEach calls fn for every vertex which is present, ordered by id
+func (n *hnswNodes) forEach(fn func(v *hnswVertex)) {
+	for _, chunk := range n.chunks {
+		for _, v := range chunk {
+			if v != nil {
+				fn(v)
+			}
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func TestHnswNodes(t *testing.T) {
+	nodes := &hnswNodes{}
+	first := &hnswVertex{id: 3}
+	nodes.set(3, first)
+	firstChunk := nodes.chunks[0]
+
+	far := &hnswVertex{id: 3 * nodesChunkSize}
+	nodes.set(far.id, far)
+
+	if nodes.capacity() != 4*nodesChunkSize {
+		t.Errorf("expected capacity of four chunks, got %d", nodes.capacity())
+	}
+
+	if &nodes.chunks[0][0] != &firstChunk[0] {
+		t.Errorf("existing chunks must not be copied when growing")
+	}
+
+	if nodes.get(3) != first || nodes.get(far.id) != far {
+		t.Errorf("expected to retrieve the vertices that were set")
+	}
+
+	if nodes.get(-1) != nil || nodes.get(10*nodesChunkSize) != nil {
+		t.Errorf("expected nil for ids out of range")
+	}
+
+	if nodes.len() != 2 {
+		t.Errorf("expected 2 vertices, got %d", nodes.len())
+	}
+
+	nodes.set(3, nil)
+	if nodes.len() != 1 {
+		t.Errorf("expected 1 vertex after removing one, got %d", nodes.len())
+	}
+}
+
+func TestInsertBeyondInitialCapacity(t *testing.T) {
+	m = newMonitoring()
+
+	vectors := randomVectors(rand.New(rand.NewSource(7)), 200, 16)
+	idFactor := 1000 // spreads the ids over multiple chunks
+	h := newTestHnsw(t, testConfig(), func(id int) []float32 { return vectors[id/idFactor] })
+
+	jobs := make(chan int)
+	wg := &sync.WaitGroup{}
+	for worker := 0; worker < 4; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				h.insert(&hnswVertex{id: i * idFactor})
+			}
+		}()
+	}
+
+	for i := range vectors {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	if h.nodes.len() != len(vectors) {
+		t.Errorf("expected %d nodes, got %d", len(vectors), h.nodes.len())
+	}
+
+	for _, violation := range h.verify() {
+		t.Errorf("unexpected violation after concurrent inserts: %s", violation.Message)
+	}
+
+	res := h.knnSearch(150*idFactor, 1, 64, nil)
+	if len(res) != 1 || res[0].id != 150*idFactor {
+		t.Errorf("expected to find node %d, got %v", 150*idFactor, res)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+// rangeSearchByVector returns every node within maxDistance of queryVector,
+// ordered by distance. The underlying search is limited to ef results, so as
+// long as the furthest result is still within the radius, there could be more
+// matches that did not fit. In that case ef is doubled and the search repeated
+// until the radius is exhausted, the whole graph has been considered or the
+// budget is exceeded. ef never grows beyond maxEf, limited is set if there
+// could be more matches once it is reached.
+func (h *hnsw) rangeSearchByVector(queryVector []float32, maxDistance float32, ef int, maxEf int,
+	allow allowList, budget *searchBudget) ([]searchResult, bool) {
+	if ef < 1 {
+		ef = 1
+	}
+	if maxEf < ef {
+		maxEf = ef
+	}
+
+	for {
+		res := h.knnSearchByVectorWithBudget(queryVector, ef, ef, allow, budget)
+
+		h.RLock()
+		total := h.nodes.len()
+		h.RUnlock()
+
+		if len(res) < ef || res[len(res)-1].distance > maxDistance || ef >= total || budget.partial() {
+			return withinDistance(res, maxDistance), false
+		}
+
+		if ef >= maxEf {
+			return withinDistance(res, maxDistance), true
+		}
+
+		ef = min(ef*2, maxEf)
+	}
+}
+
+// withinDistance expects res to be sorted by distance
+func withinDistance(res []searchResult, maxDistance float32) []searchResult {
+	for i, elem := range res {
+		if elem.distance > maxDistance {
+			return res[:i]
+		}
+	}
+
+	return res
+}
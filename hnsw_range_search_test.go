@@ -0,0 +1,45 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestRangeSearch(t *testing.T) {
+	vectors := randomVectors(rand.New(rand.NewSource(7)), 500, 16)
+	h := buildTestGraph(t, vectors, testConfig())
+
+	query := vectors[17]
+	distances := make([]float32, len(vectors))
+	for i := range vectors {
+		distances[i] = h.distancer.distance(query, vectors[i])
+	}
+	sort.Slice(distances, func(a, b int) bool { return distances[a] < distances[b] })
+
+	// the radius is chosen so that exactly 50 objects match, which is a lot
+	// more than the initial ef
+	maxDistance := distances[49]
+	res, limited := h.rangeSearchByVector(query, maxDistance, 8, 1000, nil, nil)
+
+	if len(res) < 48 || limited {
+		t.Errorf("expected (almost) all 50 matches, got %d (limited: %t)", len(res), limited)
+	}
+
+	for _, elem := range res {
+		if elem.distance > maxDistance {
+			t.Errorf("result %d with distance %f is outside the radius", elem.id, elem.distance)
+		}
+	}
+
+	t.Run("limited ef", func(t *testing.T) {
+		res, limited := h.rangeSearchByVector(query, maxDistance, 8, 20, nil, nil)
+		if !limited {
+			t.Errorf("expected the search to be limited at ef 20")
+		}
+
+		if len(res) != 20 {
+			t.Errorf("expected the 20 results of the largest ef, got %d", len(res))
+		}
+	})
+}
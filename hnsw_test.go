@@ -0,0 +1,329 @@
+package main
+
+import (
+	"math/rand"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestKnnSearchByVector(t *testing.T) {
+	vectors := randomVectors(rand.New(rand.NewSource(7)), 500, 32)
+	h := buildTestGraph(t, vectors, testConfig())
+
+	// a query vector which is not part of the index, but very close to an
+	// existing node
+	query := make([]float32, len(vectors[123]))
+	for i, v := range vectors[123] {
+		query[i] = v + 0.001
+	}
+
+	res := h.knnSearchByVector(query, 5, 64, nil)
+	if len(res) != 5 {
+		t.Fatalf("expected 5 results, got %d", len(res))
+	}
+
+	if res[0].id != 123 {
+		t.Errorf("expected closest node to be 123, got %d", res[0].id)
+	}
+
+	for i := 1; i < len(res); i++ {
+		if res[i].distance < res[i-1].distance {
+			t.Errorf("expected results to be sorted by distance, got %v", res)
+		}
+	}
+}
+
+// testConfig is small enough to build graphs of a few hundred nodes quickly,
+// tests override single fields where they need to
+func testConfig() hnswConfig {
+	return hnswConfig{
+		maximumConnections: 8,
+		efConstruction:     64,
+		neighborSelection: neighborSelection{
+			algorithm:             neighborSelectionHeuristic,
+			keepPrunedConnections: true,
+		},
+	}
+}
+
+// buildTestGraph inserts all vectors in order, the ids are their positions.
+// It also sets up the global monitoring the graph reports to.
+func buildTestGraph(t testing.TB, vectors [][]float32, cfg hnswConfig) *hnsw {
+	m = newMonitoring()
+
+	h := newTestHnsw(t, cfg, func(id int) []float32 { return vectors[id] })
+	for i := range vectors {
+		h.insert(&hnswVertex{id: i})
+	}
+
+	return h
+}
+
+// newTestHnsw creates an index with a commit log that is discarded, so tests
+// don't depend on the ./data folder
+func newTestHnsw(t testing.TB, cfg hnswConfig, vectorForID func(int) []float32) *hnsw {
+	logFile, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := newHnswWithCommitLogger("test", cfg, vectorForID, &hnswCommitLogger{
+		events:  make(chan []byte),
+		logFile: logFile,
+	})
+	h.commitLog.StartLogging()
+	return h
+}
+
+func randomVectors(r *rand.Rand, amount, dims int) [][]float32 {
+	out := make([][]float32, amount)
+	for i := range out {
+		out[i] = make([]float32, dims)
+		for j := range out[i] {
+			out[i][j] = r.Float32()*2 - 1
+		}
+	}
+
+	return out
+}
+
+func TestDelete(t *testing.T) {
+	vectors := randomVectors(rand.New(rand.NewSource(7)), 300, 16)
+	h := buildTestGraph(t, vectors, testConfig())
+
+	deleted := map[int]struct{}{h.entryPointID: struct{}{}}
+	for i := 0; i < len(vectors); i += 3 {
+		deleted[i] = struct{}{}
+	}
+
+	for id := range deleted {
+		if err := h.delete(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assertNoDeletedResults := func(t *testing.T) {
+		for id := range deleted {
+			res := h.knnSearch(id, 10, 64, nil)
+			if len(res) != 10 {
+				t.Fatalf("expected 10 results, got %d", len(res))
+			}
+
+			for _, elem := range res {
+				if _, ok := deleted[elem.id]; ok {
+					t.Fatalf("deleted node %d returned as result", elem.id)
+				}
+			}
+		}
+	}
+
+	t.Run("tombstoned nodes are skipped", assertNoDeletedResults)
+
+	if err := h.cleanUpTombstones(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("deleted nodes are removed from the graph", func(t *testing.T) {
+		if _, ok := deleted[h.entryPointID]; ok {
+			t.Errorf("entrypoint %d was deleted, but not replaced", h.entryPointID)
+		}
+
+		h.nodes.forEach(func(node *hnswVertex) {
+			if _, ok := deleted[node.id]; ok {
+				t.Fatalf("deleted node %d still present", node.id)
+			}
+
+			for level, conns := range node.connections {
+				for _, conn := range conns {
+					if _, ok := deleted[int(conn)]; ok {
+						t.Fatalf("node %d still linked to deleted node %d at level %d",
+							node.id, conn, level)
+					}
+				}
+			}
+		})
+	})
+
+	t.Run("search still works after the cleanup", assertNoDeletedResults)
+
+	t.Run("deleting an unknown node", func(t *testing.T) {
+		if err := h.delete(len(vectors) + 1); err == nil {
+			t.Errorf("expected an error")
+		}
+	})
+
+	t.Run("inserting a deleted node again", func(t *testing.T) {
+		if err := h.delete(1); err != nil {
+			t.Fatal(err)
+		}
+
+		h.insert(&hnswVertex{id: 1})
+		if err := h.cleanUpTombstones(); err != nil {
+			t.Fatal(err)
+		}
+
+		if h.nodes.get(1) == nil {
+			t.Fatal("expected the node to survive the cleanup")
+		}
+
+		if res := h.knnSearch(1, 1, 64, nil); len(res) != 1 || res[0].id != 1 {
+			t.Errorf("expected node 1 to be found, got %v", res)
+		}
+	})
+}
+
+func TestReassignNeighborsKeepsConcurrentLinks(t *testing.T) {
+	vectors := randomVectors(rand.New(rand.NewSource(7)), 300, 16)
+	h := buildTestGraph(t, vectors, testConfig())
+
+	node := h.nodes.get(0)
+	deletedID := int(node.connections[0][0])
+
+	// a copy of the node is the closest possible neighbor, so it is selected
+	// no matter how many candidates there are
+	newLink := len(vectors)
+	vectors = append(vectors, vectors[0])
+
+	// a concurrent insert links to the node while the reassignment calculates
+	// distances to select the new connections
+	var once sync.Once
+	h.vectorForID = func(id int) []float32 {
+		once.Do(func() { node.linkAtLevel(0, uint32(newLink), h.commitLog) })
+		return vectors[id]
+	}
+	h.reassignNeighborsOf(node, map[int]struct{}{deletedID: struct{}{}})
+
+	if !containsID(node.connections[0], uint32(newLink)) {
+		t.Errorf("expected the link to %d which was added in the meantime to be kept", newLink)
+	}
+
+	if containsID(node.connections[0], uint32(deletedID)) {
+		t.Errorf("expected the link to the deleted node %d to be replaced", deletedID)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	vectors := randomVectors(rand.New(rand.NewSource(7)), 300, 16)
+	h := buildTestGraph(t, vectors, testConfig())
+
+	oldConnections := map[int][]uint32{}
+	for level, conns := range h.nodes.get(42).connections {
+		oldConnections[level] = conns
+	}
+
+	// move node 42 right next to node 7
+	updated := make([]float32, len(vectors[7]))
+	for i, v := range vectors[7] {
+		updated[i] = v + 0.001
+	}
+	vectors[42] = updated
+
+	if err := h.update(42); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("the node is found at its new position", func(t *testing.T) {
+		res := h.knnSearch(7, 2, 64, nil)
+		if len(res) != 2 || res[1].id != 42 {
+			t.Errorf("expected 42 to be the closest neighbor of 7, got %v", res)
+		}
+	})
+
+	t.Run("former neighbors no longer link to the node", func(t *testing.T) {
+		for level, conns := range oldConnections {
+			for _, id := range conns {
+				if containsID(h.nodes.get(42).connections[level], id) {
+					// still a neighbor after the update
+					continue
+				}
+
+				if containsID(h.nodes.get(int(id)).connections[level], 42) {
+					t.Errorf("node %d still links to 42 at level %d", id, level)
+				}
+			}
+		}
+	})
+
+	t.Run("updating an unknown node", func(t *testing.T) {
+		if err := h.update(len(vectors) + 1); err == nil {
+			t.Errorf("expected an error")
+		}
+	})
+}
+
+func TestFilteredSearch(t *testing.T) {
+	vectors := randomVectors(rand.New(rand.NewSource(7)), 300, 16)
+	h := buildTestGraph(t, vectors, testConfig())
+
+	var everyTenth []int
+	for i := 0; i < len(vectors); i += 10 {
+		everyTenth = append(everyTenth, i)
+	}
+
+	tests := []struct {
+		name     string
+		allow    allowList
+		expected int
+	}{
+		{"set", newIDSetAllowList(everyTenth...), 10},
+		{"bitmap", newBitmapAllowList(everyTenth...), 10},
+		{"fewer allowed than k", newBitmapAllowList(3, 150, 299), 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res := h.knnSearchByVector(vectors[5], 10, 64, test.allow)
+			if len(res) != test.expected {
+				t.Fatalf("expected %d results, got %d", test.expected, len(res))
+			}
+
+			for _, elem := range res {
+				if !test.allow.contains(elem.id) {
+					t.Errorf("node %d is not allowed", elem.id)
+				}
+			}
+		})
+	}
+}
+
+func TestSparselyFilteredSearch(t *testing.T) {
+	r := rand.New(rand.NewSource(7))
+	vectors := randomVectors(r, 5000, 32)
+	h := buildTestGraph(t, vectors, testConfig())
+
+	allowed := r.Perm(len(vectors))[:20]
+	allow := newIDSetAllowList(allowed...)
+	for i, query := range randomVectors(r, 50, 32) {
+		res, distances := h.countedKnnSearchByVector(query, 10, 64, allow, nil)
+		if len(res) != 10 {
+			t.Errorf("query %d: expected 10 of the 20 allowed nodes, got %d", i, len(res))
+		}
+
+		// traversing the graph until 64 allowed nodes are found would compare
+		// the query with every node
+		if distances > len(allowed) {
+			t.Errorf("query %d: expected at most %d distances, got %d", i, len(allowed), distances)
+		}
+
+		if expected := h.exactSearchByVector(query, 10, allow); !reflect.DeepEqual(res, expected) {
+			t.Errorf("query %d: expected %v, got %v", i, expected, res)
+		}
+	}
+}
+
+func BenchmarkKnnSearch(b *testing.B) {
+	r := rand.New(rand.NewSource(7))
+	vectors := randomVectors(r, 5000, 32)
+	queries := randomVectors(r, 100, 32)
+	cfg := testConfig()
+	cfg.maximumConnections = 16
+	cfg.efConstruction = 128
+	h := buildTestGraph(b, vectors, cfg)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.knnSearchByVector(queries[i%len(queries)], 10, 100, nil)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import "fmt"
+
+// update re-links an existing node after its vector has changed. The caller
+// is responsible for storing the new vector first, so that vectorForID
+// already returns the updated vector. The node keeps its level, but its
+// connections on every level are replaced with the best neighbors for the
+// new vector. Former neighbors no longer link to the node. One-directional
+// links from nodes which the node itself did not link to are left in place,
+// finding them would require a scan of the whole graph.
+func (h *hnsw) update(id int) error {
+	h.RLock()
+	node := h.nodes.get(id)
+	entryPointID := h.entryPointID
+	currentMaximumLayer := h.currentMaximumLayer
+	h.RUnlock()
+
+	if node == nil {
+		return fmt.Errorf("node %d does not exist", id)
+	}
+
+	node.RLock()
+	targetLevel := node.level
+	oldConnections := make(map[int][]uint32, len(node.connections))
+	for level, conns := range node.connections {
+		oldConnections[level] = conns
+	}
+	node.RUnlock()
+
+	nodeVector := h.vectorForID(id)
+	if h.compressor != nil {
+		h.compressor.encode(id, nodeVector)
+	}
+	distToNode := h.distanceToQuery(nodeVector)
+
+	// the node itself is still linked with its old connections, so the search
+	// works even if the node is the entrypoint
+	for level := currentMaximumLayer; level > targetLevel; level-- {
+		eps := newMinPriorityQueue(1)
+		eps.insert(entryPointID, distToNode(entryPointID))
+		res := h.searchLayer(distToNode, eps, 1, level, nil, nil)
+		if res.len() > 0 {
+			entryPointID = res.top().id
+		}
+	}
+
+	results := newMaxPriorityQueue(1)
+	results.insert(entryPointID, distToNode(entryPointID))
+
+	newConnections := map[int][]uint32{}
+	for level := min(targetLevel, currentMaximumLayer); level >= 0; level-- {
+		res := h.searchLayer(distToNode, results, h.efConstruction, level, nil, nil)
+		if res.len() == 0 {
+			continue
+		}
+		results = res
+
+		// selectNeighbors never links the node to itself
+		newConnections[level] = h.selectNeighbors(id, results.sorted(), h.maximumConnections, level)
+	}
+
+	for level, old := range oldConnections {
+		for _, neighborID := range old {
+			if containsID(newConnections[level], neighborID) {
+				continue
+			}
+
+			h.RLock()
+			neighbor := h.nodes.get(int(neighborID))
+			h.RUnlock()
+
+			if neighbor == nil {
+				continue
+			}
+
+			neighbor.unlinkAtLevel(level, uint32(id), h.commitLog)
+		}
+	}
+
+	for level, neighbors := range newConnections {
+		node.Lock()
+		h.commitLog.ReplaceLinksAtLevel(id, level, neighbors)
+		node.connections[level] = neighbors
+		node.Unlock()
+
+		for _, neighborID := range neighbors {
+			h.RLock()
+			neighbor := h.nodes.get(int(neighborID))
+			h.RUnlock()
+
+			if neighbor == nil {
+				// removed by a tombstone cleanup in the meantime
+				continue
+			}
+
+			neighbor.RLock()
+			alreadyLinked := containsID(neighbor.connections[level], uint32(id))
+			neighbor.RUnlock()
+
+			if alreadyLinked {
+				continue
+			}
+
+			neighbor.linkAtLevel(level, uint32(id), h.commitLog)
+
+			h.pruneConnections(neighbor, level)
+		}
+	}
+
+	return nil
+}
+
+func containsID(ids []uint32, needle uint32) bool {
+	for _, id := range ids {
+		if id == needle {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// kinds of graphViolation
+const (
+	violationMissingTarget      = "missingTarget"
+	violationTargetLevelTooLow  = "targetLevelTooLow"
+	violationSelfLink           = "selfLink"
+	violationDuplicateLink      = "duplicateLink"
+	violationConnectionsAbove   = "connectionsAboveNodeLevel"
+	violationTooManyConnections = "tooManyConnections"
+	violationEntrypointMissing  = "entrypointMissing"
+	violationEntrypointLevel    = "entrypointNotOnMaximumLayer"
+	violationNodeAboveMaximum   = "nodeAboveMaximumLayer"
+	violationUnreachable        = "unreachable"
+)
+
+// graphViolation is a single broken invariant found by verify. Level and
+// Target are only set if they apply to the kind of violation.
+type graphViolation struct {
+	Kind    string `json:"kind"`
+	NodeID  int    `json:"nodeId"`
+	Level   *int   `json:"level,omitempty"`
+	Target  *int   `json:"target,omitempty"`
+	Message string `json:"message"`
+}
+
+// verify checks the invariants of the graph and returns every violation it
+// finds, an empty list means the graph is sound. It holds the read lock for
+// the whole check, so it should not be run on a graph which is serving.
+func (h *hnsw) verify() []graphViolation {
+	h.RLock()
+	defer h.RUnlock()
+
+	violations := []graphViolation{}
+	add := func(kind string, nodeID int, level, target *int, format string, args ...interface{}) {
+		violations = append(violations, graphViolation{
+			Kind:    kind,
+			NodeID:  nodeID,
+			Level:   level,
+			Target:  target,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	h.nodes.forEach(func(node *hnswVertex) {
+		node.RLock()
+		defer node.RUnlock()
+
+		if node.level > h.currentMaximumLayer {
+			add(violationNodeAboveMaximum, node.id, intPtr(node.level), nil,
+				"node is on level %d, but the maximum layer is %d", node.level, h.currentMaximumLayer)
+		}
+
+		// sorted, so that the report is stable
+		levels := make([]int, 0, len(node.connections))
+		for level := range node.connections {
+			levels = append(levels, level)
+		}
+		sort.Ints(levels)
+
+		for _, level := range levels {
+			level := level
+			conns := node.connections[level]
+			if level > node.level && len(conns) > 0 {
+				add(violationConnectionsAbove, node.id, &level, nil,
+					"node on level %d has connections on level %d", node.level, level)
+			}
+
+			maximum := h.maximumConnections
+			if level == 0 {
+				maximum = h.maximumConnectionsLayerZero
+			}
+			if len(conns) > maximum {
+				add(violationTooManyConnections, node.id, &level, nil,
+					"%d connections, allowed are %d", len(conns), maximum)
+			}
+
+			seen := map[uint32]struct{}{}
+			for _, targetID := range conns {
+				target := int(targetID)
+				if _, ok := seen[targetID]; ok {
+					add(violationDuplicateLink, node.id, &level, &target, "link is present more than once")
+				}
+				seen[targetID] = struct{}{}
+
+				if target == node.id {
+					add(violationSelfLink, node.id, &level, &target, "node is linked to itself")
+					continue
+				}
+
+				targetNode := h.nodes.get(target)
+				if targetNode == nil {
+					add(violationMissingTarget, node.id, &level, &target, "link points to a node which does not exist")
+					continue
+				}
+
+				targetNode.RLock()
+				targetLevel := targetNode.level
+				targetNode.RUnlock()
+				if targetLevel < level {
+					add(violationTargetLevelTooLow, node.id, &level, &target,
+						"link on level %d points to a node on level %d", level, targetLevel)
+				}
+			}
+		}
+	})
+
+	if h.nodes.len() == 0 {
+		return violations
+	}
+
+	entrypoint := h.nodes.get(h.entryPointID)
+	if entrypoint == nil {
+		add(violationEntrypointMissing, h.entryPointID, nil, nil, "entrypoint does not exist")
+		return violations
+	}
+
+	entrypoint.RLock()
+	entrypointLevel := entrypoint.level
+	entrypoint.RUnlock()
+	if entrypointLevel != h.currentMaximumLayer {
+		add(violationEntrypointLevel, h.entryPointID, intPtr(entrypointLevel), nil,
+			"entrypoint is on level %d, but the maximum layer is %d", entrypointLevel, h.currentMaximumLayer)
+	}
+
+	reachable := h.reachableFrom(h.entryPointID)
+	h.nodes.forEach(func(node *hnswVertex) {
+		if _, ok := reachable[node.id]; !ok {
+			add(violationUnreachable, node.id, nil, nil, "node cannot be reached from the entrypoint")
+		}
+	})
+
+	return violations
+}
+
+// reachableFrom follows the links on layer 0, which contains every node, so
+// every node a search could ever return is part of the result. The caller
+// must hold the read lock.
+func (h *hnsw) reachableFrom(id int) map[int]struct{} {
+	reachable := map[int]struct{}{id: {}}
+	queue := []int{id}
+	for len(queue) > 0 {
+		node := h.nodes.get(queue[0])
+		queue = queue[1:]
+		if node == nil {
+			continue
+		}
+
+		node.RLock()
+		conns := node.connections[0]
+		node.RUnlock()
+
+		for _, targetID := range conns {
+			if _, ok := reachable[int(targetID)]; ok {
+				continue
+			}
+
+			reachable[int(targetID)] = struct{}{}
+			queue = append(queue, int(targetID))
+		}
+	}
+
+	return reachable
+}
+
+func intPtr(i int) *int {
+	return &i
+}
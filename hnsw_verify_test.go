@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	m = newMonitoring()
+
+	logFile, err := ioutil.TempFile("", "hnsw_commit_log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(logFile.Name())
+
+	vectors := randomVectors(rand.New(rand.NewSource(7)), 300, 16)
+	cfg := testConfig()
+	commitLog := &hnswCommitLogger{events: make(chan []byte), logFile: logFile}
+	commitLog.StartLogging()
+	h := newHnswWithCommitLogger("test", cfg, func(id int) []float32 { return vectors[id] }, commitLog)
+
+	for i := range vectors {
+		h.insert(&hnswVertex{id: i})
+	}
+	for _, id := range []int{3, 50, h.entryPointID} {
+		if err := h.delete(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := h.cleanUpTombstones(); err != nil {
+		t.Fatal(err)
+	}
+	if err := commitLog.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if violations := h.verify(); len(violations) != 0 {
+		t.Fatalf("expected a sound graph, got %v", violations)
+	}
+
+	t.Run("replaying the commit log", func(t *testing.T) {
+		replayed := newHnswWithCommitLogger("replayed", cfg, nil, nil)
+		if err := replayCommitLogFile(logFile.Name(), replayed); err != nil {
+			t.Fatal(err)
+		}
+
+		if replayed.entryPointID != h.entryPointID || replayed.currentMaximumLayer != h.currentMaximumLayer {
+			t.Errorf("expected entrypoint %d on layer %d, got %d on layer %d", h.entryPointID,
+				h.currentMaximumLayer, replayed.entryPointID, replayed.currentMaximumLayer)
+		}
+
+		if replayed.nodes.len() != h.nodes.len() {
+			t.Fatalf("expected %d nodes, got %d", h.nodes.len(), replayed.nodes.len())
+		}
+
+		h.nodes.forEach(func(node *hnswVertex) {
+			other := replayed.nodes.get(node.id)
+			if other == nil || other.level != node.level ||
+				!reflect.DeepEqual(withoutEmptyLevels(other.connections), withoutEmptyLevels(node.connections)) {
+				t.Errorf("node %d differs after replay", node.id)
+			}
+		})
+
+		if violations := replayed.verify(); len(violations) != 0 {
+			t.Errorf("expected a sound graph, got %v", violations)
+		}
+	})
+
+	t.Run("finding violations", func(t *testing.T) {
+		broken := newHnswWithCommitLogger("broken", hnswConfig{maximumConnections: 1}, nil, nil)
+		broken.nodes.set(0, &hnswVertex{id: 0, level: 1, connections: map[int][]uint32{
+			0: {1, 7}, // 7 does not exist
+			1: {1},    // 1 is only on level 0
+		}})
+		broken.nodes.set(1, &hnswVertex{id: 1, connections: map[int][]uint32{
+			0: {0, 1, 0, 0}, // too many, self link and a duplicate
+		}})
+		broken.nodes.set(2, &hnswVertex{id: 2, connections: map[int][]uint32{}})
+		broken.entryPointID = 1
+		broken.currentMaximumLayer = 1
+
+		kinds := map[string]int{}
+		for _, v := range broken.verify() {
+			kinds[v.Kind]++
+		}
+
+		expected := map[string]int{
+			violationMissingTarget:      1,
+			violationTargetLevelTooLow:  1,
+			violationTooManyConnections: 1,
+			violationSelfLink:           1,
+			violationDuplicateLink:      2,
+			violationEntrypointLevel:    1,
+			violationUnreachable:        1,
+		}
+		if !reflect.DeepEqual(kinds, expected) {
+			t.Errorf("expected violations %v, got %v", expected, kinds)
+		}
+	})
+}
+
+func withoutEmptyLevels(connections map[int][]uint32) map[int][]uint32 {
+	out := map[int][]uint32{}
+	for level, conns := range connections {
+		if len(conns) > 0 {
+			out[level] = conns
+		}
+	}
+	return out
+}
@@ -3,51 +3,100 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/davecgh/go-spew/spew"
 )
 
+// handlers serve the primary index, the secondary is optional and must be a
+// nil interface if it is not present
 type handlers struct {
-	primary   *hnsw
-	secondary *hnsw
-	getIndex  getIndexFn
-	getData   getDataFn
+	primary    vectorIndex
+	secondary  vectorIndex
+	ids        *idMapping
+	properties *propertyStore
+	text       *textIndex
 }
-type getIndexFn func(name string) int64
-type getDataFn func(int64) string
 
-func newHandlers(primary *hnsw, secondary *hnsw, getIndex getIndexFn, getData getDataFn) *handlers {
-	return &handlers{primary: primary, secondary: secondary, getIndex: getIndex, getData: getData}
+func newHandlers(primary vectorIndex, secondary vectorIndex, ids *idMapping,
+	properties *propertyStore, text *textIndex) *handlers {
+	return &handlers{primary: primary, secondary: secondary, ids: ids, properties: properties,
+		text: text}
+}
+
+func (h *handlers) objects(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.getObjects(w, r)
+	case http.MethodPut:
+		h.updateObject(w, r)
+	case http.MethodDelete:
+		h.deleteObject(w, r)
+	default:
+		http.Error(w, "only GET, PUT and DELETE are supported", http.StatusMethodNotAllowed)
+	}
 }
 
 func (h *handlers) getObjects(w http.ResponseWriter, r *http.Request) {
 	qv := r.URL.Query()
 	name := qv.Get("name")
-	sizeStr := qv.Get("size")
 	_, secondary := qv["secondary"]
-	var size int
-	if sizeStr == "" {
-		size = 15
-	} else {
-		size, _ = strconv.Atoi(sizeStr)
+	_, includeVector := qv["includeVector"]
+	_, includeProperties := qv["includeProperties"]
+
+	var size, ef int
+	for _, param := range []struct {
+		name   string
+		target *int
+	}{{"size", &size}, {"ef", &ef}} {
+		str := qv.Get(param.name)
+		if str == "" {
+			continue
+		}
+
+		parsed, err := strconv.Atoi(str)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid %s: %v", param.name, err), http.StatusBadRequest)
+			return
+		}
+		*param.target = parsed
 	}
 
-	indexPos := h.getIndex(name)
+	controls, err := parseQueryControls(size, ef, qv.Get("timeout"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := h.ids.internalID(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	indexPos := int64(id)
 	before := time.Now()
 	// filter := qv.Get("filter") != ""
 	benchmark := qv.Get("benchmark") != ""
 	if benchmark {
-		h.benchmark(w, r, indexPos, size)
+		h.benchmark(w, r, indexPos, controls.k)
 		return
 	}
 
-	var g *hnsw
+	var g vectorIndex
 	if secondary {
+		if h.secondary == nil {
+			http.Error(w, "no secondary index present", http.StatusBadRequest)
+			return
+		}
 		fmt.Println("serving from secondary index")
 		g = h.secondary
 	} else {
@@ -55,26 +104,518 @@ func (h *handlers) getObjects(w http.ResponseWriter, r *http.Request) {
 		g = h.primary
 	}
 
-	res := g.knnSearch(int(indexPos), size, 100)
-	took := time.Since(before)
+	var names []string
+	for _, param := range qv["allow"] {
+		names = append(names, strings.Split(param, ",")...)
+	}
 
-	results := make([]result, len(res))
-	for i, elem := range res {
-		object := h.getData(int64(elem))
-		results[i] = result{
-			Object: object,
-			// Distance: elem.distance,
+	var where *filter
+	if whereStr := qv.Get("where"); whereStr != "" {
+		where, err = parseFilter([]byte(whereStr))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
 	}
 
+	allow, err := h.allowList(names, where)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	var res []searchResult
+	var limited bool
+	if maxDistanceStr := qv.Get("maxDistance"); maxDistanceStr != "" {
+		maxDistance, err := strconv.ParseFloat(maxDistanceStr, 32)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid maxDistance: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		res, limited = g.rangeSearchByVector(g.vectorOf(int(indexPos)), float32(maxDistance),
+			controls.ef, flagMaxEf, allow, controls.budget)
+	} else {
+		res = g.knnSearchByVectorWithBudget(g.vectorOf(int(indexPos)), controls.k,
+			controls.ef, allow, controls.budget)
+	}
+	took := time.Since(before)
+
 	list := resultsList{
-		Results: results,
+		Results: h.results(g, res, includeVector, includeProperties),
 		Took:    fmt.Sprintf("%s", took),
+		Partial: controls.budget.partial() || limited,
+	}
+
+	json.NewEncoder(w).Encode(list)
+}
+
+// deleteObject marks the object as deleted in both indexes, it is removed from
+// the graphs by the next tombstone cleanup
+func (h *handlers) deleteObject(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+
+	id, err := h.ids.internalID(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	indexPos := int64(id)
+	for _, g := range []vectorIndex{h.primary, h.secondary} {
+		if g == nil {
+			continue
+		}
+
+		if err := g.delete(int(indexPos)); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	}
+	h.text.delete(int(indexPos))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type updateRequest struct {
+	Name   string    `json:"name"`
+	Vector []float32 `json:"vector"`
+
+	// replaces all properties of the object if set, {} removes them
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// updateObject replaces the vector of an existing object and re-links it in
+// both indexes. It also replaces the properties of the object, at least one
+// of vector and properties must be set.
+func (h *handlers) updateObject(w http.ResponseWriter, r *http.Request) {
+	var req updateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if req.Name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+
+	if req.Vector == nil && req.Properties == nil {
+		http.Error(w, "at least one of vector and properties is required", http.StatusBadRequest)
+		return
+	}
+
+	if req.Vector != nil && len(req.Vector) != vectorDimensions {
+		http.Error(w, fmt.Sprintf("vector must have %d dimensions, got %d",
+			vectorDimensions, len(req.Vector)), http.StatusBadRequest)
+		return
+	}
+
+	id, err := h.ids.internalID(req.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if req.Properties != nil {
+		if err := h.properties.set(int(id), req.Properties); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h.text.index(int(id), append([]string{req.Name}, h.properties.texts(int(id))...))
+	}
+
+	if req.Vector == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	indexPos := int64(id)
+	if err := putVector(indexPos, req.Vector); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for _, g := range []vectorIndex{h.primary, h.secondary} {
+		if g == nil {
+			continue
+		}
+
+		if err := g.update(int(indexPos)); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type searchRequest struct {
+	// either a vector or the name of an existing object to use as the query
+	Vector []float32 `json:"vector"`
+	Name   string    `json:"name"`
+
+	// k, defaults to 15
+	Size int `json:"size"`
+
+	// optional, defaults to the server-wide ef and is raised to size if lower
+	Ef int `json:"ef"`
+
+	// optional time budget such as "50ms", once exceeded the best results found
+	// so far are returned and marked as partial
+	Timeout string `json:"timeout"`
+
+	Secondary bool `json:"secondary"`
+
+	// return the vectors as they were imported, even if the index only holds
+	// a normalized copy
+	IncludeVector bool `json:"includeVector"`
+
+	// optional, if set only these objects are returned
+	AllowList []string `json:"allowList"`
+
+	// optional, only objects whose properties match are returned, see filter
+	Where *filter `json:"where"`
+
+	IncludeProperties bool `json:"includeProperties"`
+
+	// optional keywords, if set the results of a BM25 search over the names
+	// and string properties are fused with the vector results
+	Query string `json:"query"`
+
+	// how keyword and vector results are fused, "rrf" (reciprocal rank
+	// fusion, the default) or "blend"
+	Fusion string `json:"fusion"`
+
+	// the weight of the vector results in a blend between 0 and 1, defaults
+	// to 0.5
+	Alpha *float32 `json:"alpha"`
+
+	// optional, if set every object within this distance is returned and size
+	// is ignored
+	MaxDistance *float32 `json:"maxDistance"`
+}
+
+// searchByVector finds the nearest neighbors of an arbitrary query vector,
+// such as a fresh embedding that was never imported
+func (h *handlers) searchByVector(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req searchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	list, err := h.search(req)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
 	}
 
 	json.NewEncoder(w).Encode(list)
 }
 
+// search validates and runs a single query. All errors are caused by invalid
+// requests or references to objects which don't exist.
+func (h *handlers) search(req searchRequest) (resultsList, error) {
+	before := time.Now()
+
+	if (req.Name == "") == (req.Vector == nil) {
+		return resultsList{}, fmt.Errorf("exactly one of name and vector must be set")
+	}
+
+	if req.Vector != nil && len(req.Vector) != vectorDimensions {
+		return resultsList{}, fmt.Errorf("vector must have %d dimensions, got %d",
+			vectorDimensions, len(req.Vector))
+	}
+
+	controls, err := parseQueryControls(req.Size, req.Ef, req.Timeout)
+	if err != nil {
+		return resultsList{}, err
+	}
+
+	g := h.primary
+	if req.Secondary {
+		if h.secondary == nil {
+			return resultsList{}, fmt.Errorf("no secondary index present")
+		}
+		g = h.secondary
+	}
+
+	query := req.Vector
+	if req.Name != "" {
+		id, err := h.ids.internalID(req.Name)
+		if err != nil {
+			return resultsList{}, err
+		}
+		query = g.vectorOf(int(id))
+	}
+
+	allow, err := h.allowList(req.AllowList, req.Where)
+	if err != nil {
+		return resultsList{}, err
+	}
+
+	var res []searchResult
+	var scores []float32
+	var limited bool
+	switch {
+	case req.Query != "":
+		if req.MaxDistance != nil {
+			return resultsList{}, fmt.Errorf("query cannot be combined with maxDistance")
+		}
+
+		res, scores, err = h.hybridSearch(g, query, req, controls, allow)
+		if err != nil {
+			return resultsList{}, err
+		}
+	case req.Fusion != "" || req.Alpha != nil:
+		return resultsList{}, fmt.Errorf("fusion and alpha require a query")
+	case req.MaxDistance != nil:
+		res, limited = g.rangeSearchByVector(query, *req.MaxDistance, controls.ef, flagMaxEf, allow,
+			controls.budget)
+	default:
+		res = g.knnSearchByVectorWithBudget(query, controls.k, controls.ef, allow, controls.budget)
+	}
+
+	results := h.results(g, res, req.IncludeVector, req.IncludeProperties)
+	for i := range scores {
+		results[i].Score = &scores[i]
+	}
+
+	return resultsList{
+		Results: results,
+		Took:    fmt.Sprintf("%s", time.Since(before)),
+		Partial: controls.budget.partial() || limited,
+	}, nil
+}
+
+// queryControls are the validated speed/recall trade-offs of a single query
+type queryControls struct {
+	k      int
+	ef     int
+	budget *searchBudget
+}
+
+// parseQueryControls applies the defaults for unset (zero) values and
+// rejects everything outside of the limits configured for the server
+func parseQueryControls(k, ef int, timeout string) (queryControls, error) {
+	if k == 0 {
+		k = 15
+	}
+
+	if ef == 0 {
+		ef = flagEf
+	}
+
+	if k < 0 {
+		return queryControls{}, fmt.Errorf("size must be positive, got %d", k)
+	}
+
+	if ef < 0 {
+		return queryControls{}, fmt.Errorf("ef must be positive, got %d", ef)
+	}
+
+	if k > flagMaxEf {
+		return queryControls{}, fmt.Errorf("size must be at most %d, got %d", flagMaxEf, k)
+	}
+
+	if ef > flagMaxEf {
+		return queryControls{}, fmt.Errorf("ef must be at most %d, got %d", flagMaxEf, ef)
+	}
+
+	if ef < k {
+		// the search can never return more than ef results
+		ef = k
+	}
+
+	controls := queryControls{k: k, ef: ef}
+	if timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			return queryControls{}, fmt.Errorf("invalid timeout: %v", err)
+		}
+
+		if d <= 0 {
+			return queryControls{}, fmt.Errorf("timeout must be positive, got %s", d)
+		}
+
+		controls.budget = newSearchBudget(d)
+	}
+
+	return controls, nil
+}
+
+type batchSearchRequest struct {
+	Queries []searchRequest `json:"queries"`
+}
+
+type batchResultsList struct {
+	Took string `json:"took"`
+
+	// one entry per query in the order of the request
+	Results []resultsList `json:"results"`
+}
+
+// maxBatchSize limits the amount of memory a single request can occupy
+const maxBatchSize = 10000
+
+// batchSearch runs many queries in parallel on a bounded number of workers.
+// An invalid query does not fail the whole batch, its error is reported in
+// its own result instead.
+func (h *handlers) batchSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	before := time.Now()
+	var req batchSearchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Queries) > maxBatchSize {
+		http.Error(w, fmt.Sprintf("at most %d queries per batch are allowed, got %d",
+			maxBatchSize, len(req.Queries)), http.StatusBadRequest)
+		return
+	}
+
+	results := make([]resultsList, len(req.Queries))
+	jobs := make(chan int)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pos := range jobs {
+				list, err := h.search(req.Queries[pos])
+				if err != nil {
+					list.Error = err.Error()
+				}
+				results[pos] = list
+			}
+		}()
+	}
+
+	for pos := range req.Queries {
+		jobs <- pos
+	}
+	close(jobs)
+	wg.Wait()
+
+	json.NewEncoder(w).Encode(batchResultsList{
+		Results: results,
+		Took:    fmt.Sprintf("%s", time.Since(before)),
+	})
+}
+
+// errorStatus distinguishes references to unknown objects from otherwise
+// invalid requests
+func errorStatus(err error) int {
+	if errors.Is(err, errObjectNotFound) {
+		return http.StatusNotFound
+	}
+
+	return http.StatusBadRequest
+}
+
+// allowList combines the names and the filter, both are optional. It returns
+// nil if neither is set, so that the search is not restricted at all.
+func (h *handlers) allowList(names []string, where *filter) (allowList, error) {
+	allow, err := h.allowListFromNames(names)
+	if err != nil || where == nil {
+		return allow, err
+	}
+
+	matches, err := where.compile(h.properties, h.ids.nextInternalID())
+	if err != nil {
+		return nil, err
+	}
+
+	if allow == nil {
+		return matches, nil
+	}
+
+	allowed := newBitmapAllowList()
+	for id := range allow.(idSetAllowList) {
+		allowed.add(id)
+	}
+
+	return matches.intersect(allowed), nil
+}
+
+// allowListFromNames returns nil if no names are set, so that the search is
+// not restricted at all. Unknown names are an error rather than being
+// silently dropped.
+func (h *handlers) allowListFromNames(names []string) (allowList, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]int, len(names))
+	for i, name := range names {
+		id, err := h.ids.internalID(name)
+		if err != nil {
+			return nil, fmt.Errorf("allow list: %w", err)
+		}
+		ids[i] = int(id)
+	}
+
+	return newIDSetAllowList(ids...), nil
+}
+
+func (h *handlers) results(g vectorIndex, res []searchResult,
+	includeVector, includeProperties bool) []result {
+	results := make([]result, len(res))
+	for i, elem := range res {
+		object, err := h.ids.externalID(uint32(elem.id))
+		if err != nil {
+			fmt.Printf("id mapping error: %v\n", err)
+		}
+		results[i] = result{
+			Object:   object,
+			Distance: elem.distance,
+		}
+
+		if includeVector {
+			// bolt holds the original, the cache might only have a normalized copy
+			vector, err := readVectorFromBolt(int64(elem.id))
+			if err != nil {
+				fmt.Printf("bolt read error: %v\n", err)
+			}
+			results[i].Vector = vector
+		}
+
+		if includeProperties {
+			results[i].Properties = h.properties.get(elem.id)
+		}
+
+		if g.metric() == metricCosine {
+			// the other metrics are unbounded, so there is no meaningful certainty
+			certainty := certaintyFromCosineDistance(elem.distance)
+			results[i].Certainty = &certainty
+		}
+	}
+
+	return results
+}
+
+// certaintyFromCosineDistance normalizes a cosine distance (0..2) into a
+// score between 0 and 1 where 1 means the vectors point in the same direction
+func certaintyFromCosineDistance(dist float32) float32 {
+	return 1 - dist/2
+}
+
 func (h *handlers) benchmark(w http.ResponseWriter, r *http.Request, indexPos int64, size int) {
 	vector, err := readVectorFromBolt(indexPos)
 	if err != nil {
@@ -126,9 +667,21 @@ func (h *handlers) benchmark(w http.ResponseWriter, r *http.Request, indexPos in
 type resultsList struct {
 	Took    string   `json:"took"`
 	Results []result `json:"results"`
+	Error   string   `json:"error,omitempty"`
+
+	// set if the time budget was exceeded before the search completed, or if
+	// a range search reached max-ef while there could be more matches
+	Partial bool `json:"partial,omitempty"`
 }
 
 type result struct {
-	Object   interface{}
-	Distance float32
+	Object    interface{}
+	Distance  float32
+	Certainty *float32  `json:",omitempty"`
+	Vector    []float32 `json:",omitempty"`
+
+	Properties map[string]interface{} `json:",omitempty"`
+
+	// the fused score of a hybrid search, higher is better
+	Score *float32 `json:",omitempty"`
 }
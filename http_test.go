@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBatchSearch(t *testing.T) {
+	m = newMonitoring()
+
+	vectors := randomVectors(rand.New(rand.NewSource(7)), 100, vectorDimensions)
+	ids, err := newIDMapping(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	properties, err := newPropertyStore(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index := newFlatIndex(flatConfig{}, func(id int) []float32 { return vectors[id] })
+	for i := range vectors {
+		if _, err := ids.add(fmt.Sprintf("object-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+		index.add(i)
+	}
+
+	h := newHandlers(index, nil, ids, properties, newTextIndexFrom(ids, properties, index))
+	server := httptest.NewServer(http.HandlerFunc(h.batchSearch))
+	defer server.Close()
+
+	post := func(req batchSearchRequest) *http.Response {
+		body, err := json.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := http.Post(server.URL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return res
+	}
+
+	t.Run("results are in the order of the queries", func(t *testing.T) {
+		// more queries than workers, so that they complete out of order
+		var req batchSearchRequest
+		for i := range vectors {
+			req.Queries = append(req.Queries, searchRequest{Name: fmt.Sprintf("object-%d", i), Size: 1})
+		}
+		invalid := 42
+		req.Queries[invalid] = searchRequest{Name: "object-42", Size: 1, Fusion: "max"}
+
+		res := post(req)
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", res.StatusCode)
+		}
+
+		var list batchResultsList
+		if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(list.Results) != len(req.Queries) {
+			t.Fatalf("expected %d results, got %d", len(req.Queries), len(list.Results))
+		}
+
+		for i, results := range list.Results {
+			if i == invalid {
+				if results.Error == "" || len(results.Results) != 0 {
+					t.Errorf("query %d: expected only an error, got %+v", i, results)
+				}
+				continue
+			}
+
+			if results.Error != "" {
+				t.Errorf("query %d: expected no error, got %q", i, results.Error)
+			}
+
+			// every object is its own nearest neighbor
+			expected := fmt.Sprintf("object-%d", i)
+			if len(results.Results) != 1 || results.Results[0].Object != expected {
+				t.Errorf("query %d: expected %s, got %+v", i, expected, results.Results)
+			}
+		}
+	})
+
+	t.Run("too many queries", func(t *testing.T) {
+		res := post(batchSearchRequest{Queries: make([]searchRequest, maxBatchSize+1)})
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", res.StatusCode)
+		}
+	})
+}
+
+func TestParseQueryControls(t *testing.T) {
+	defer func(ef, maxEf int) { flagEf, flagMaxEf = ef, maxEf }(flagEf, flagMaxEf)
+	flagEf, flagMaxEf = 100, 1000
+
+	tests := []struct {
+		name      string
+		k, ef     int
+		timeout   string
+		expectErr bool
+		expectK   int
+		expectEf  int
+		budget    bool
+	}{
+		{name: "defaults", expectK: 15, expectEf: 100},
+		{name: "explicit", k: 5, ef: 50, expectK: 5, expectEf: 50},
+		{name: "ef raised to k", k: 200, ef: 50, expectK: 200, expectEf: 200},
+		{name: "default ef raised to k", k: 500, expectK: 500, expectEf: 500},
+		{name: "limits are inclusive", k: 1000, ef: 1000, expectK: 1000, expectEf: 1000},
+		{name: "negative size", k: -1, expectErr: true},
+		{name: "negative ef", ef: -1, expectErr: true},
+		{name: "size above max ef", k: 1001, expectErr: true},
+		{name: "ef above max ef", ef: 1001, expectErr: true},
+		{name: "timeout", timeout: "50ms", expectK: 15, expectEf: 100, budget: true},
+		{name: "invalid timeout", timeout: "soon", expectErr: true},
+		{name: "timeout without unit", timeout: "50", expectErr: true},
+		{name: "zero timeout", timeout: "0s", expectErr: true},
+		{name: "negative timeout", timeout: "-5ms", expectErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			controls, err := parseQueryControls(test.k, test.ef, test.timeout)
+			if test.expectErr {
+				if err == nil {
+					t.Errorf("expected an error, got %+v", controls)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if controls.k != test.expectK || controls.ef != test.expectEf {
+				t.Errorf("expected k %d and ef %d, got k %d and ef %d", test.expectK, test.expectEf,
+					controls.k, controls.ef)
+			}
+
+			if (controls.budget != nil) != test.budget {
+				t.Errorf("expected a budget: %t, got %+v", test.budget, controls.budget)
+			}
+
+			if test.budget && time.Until(controls.budget.deadline) > time.Minute {
+				t.Errorf("expected the deadline to follow the timeout, got %s", controls.budget.deadline)
+			}
+		})
+	}
+}
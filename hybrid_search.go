@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+const (
+	fusionReciprocalRank = "rrf"
+	fusionBlend          = "blend"
+)
+
+// rrfRankConstant dampens the influence of the top ranks, 60 is the value
+// from the original paper
+const rrfRankConstant = 60
+
+type fusedResult struct {
+	id    int
+	score float32
+}
+
+// fuseReciprocalRank scores every object with the sum of 1/(60+rank) over
+// both lists. It only looks at the ranks, so the scales of distances and
+// BM25 scores don't matter.
+func fuseReciprocalRank(vector []searchResult, keyword []textResult) []fusedResult {
+	scores := map[int]float32{}
+	for rank, res := range vector {
+		scores[res.id] += 1 / float32(rrfRankConstant+rank+1)
+	}
+
+	for rank, res := range keyword {
+		scores[res.id] += 1 / float32(rrfRankConstant+rank+1)
+	}
+
+	return sortedByScore(scores)
+}
+
+// fuseBlend scales the distances and the BM25 scores to 0..1 within each list
+// and blends them, alpha is the weight of the vector results. An object
+// missing from a list scores 0 there.
+func fuseBlend(vector []searchResult, keyword []textResult, alpha float32) []fusedResult {
+	scores := map[int]float32{}
+	if len(vector) > 0 {
+		closest, furthest := vector[0].distance, vector[len(vector)-1].distance
+		for _, res := range vector {
+			normalized := float32(1)
+			if furthest > closest {
+				normalized = (furthest - res.distance) / (furthest - closest)
+			}
+			scores[res.id] += alpha * normalized
+		}
+	}
+
+	if len(keyword) > 0 {
+		best, worst := keyword[0].score, keyword[len(keyword)-1].score
+		for _, res := range keyword {
+			normalized := float32(1)
+			if best > worst {
+				normalized = (res.score - worst) / (best - worst)
+			}
+			scores[res.id] += (1 - alpha) * normalized
+		}
+	}
+
+	return sortedByScore(scores)
+}
+
+func sortedByScore(scores map[int]float32) []fusedResult {
+	out := make([]fusedResult, 0, len(scores))
+	for id, score := range scores {
+		out = append(out, fusedResult{id: id, score: score})
+	}
+
+	sort.Slice(out, func(a, b int) bool {
+		if out[a].score != out[b].score {
+			return out[a].score > out[b].score
+		}
+		return out[a].id < out[b].id
+	})
+
+	return out
+}
+
+// hybridSearch fuses the ef nearest neighbors of the query vector with the ef
+// best keyword matches and returns the k best fused results along with their
+// scores. Objects which were only found by keyword get their actual distance
+// to the query vector.
+func (h *handlers) hybridSearch(g vectorIndex, queryVector []float32, req searchRequest,
+	controls queryControls, allow allowList) ([]searchResult, []float32, error) {
+	alpha := float32(0.5)
+	if req.Alpha != nil {
+		alpha = *req.Alpha
+	}
+
+	if alpha < 0 || alpha > 1 {
+		return nil, nil, fmt.Errorf("alpha must be between 0 and 1, got %f", alpha)
+	}
+
+	vector := g.knnSearchByVectorWithBudget(queryVector, controls.ef, controls.ef, allow,
+		controls.budget)
+	keyword := h.text.search(req.Query, controls.ef, allow)
+
+	var fused []fusedResult
+	switch req.Fusion {
+	case "", fusionReciprocalRank:
+		if req.Alpha != nil {
+			return nil, nil, fmt.Errorf("alpha is only supported by the %s fusion", fusionBlend)
+		}
+		fused = fuseReciprocalRank(vector, keyword)
+	case fusionBlend:
+		fused = fuseBlend(vector, keyword, alpha)
+	default:
+		return nil, nil, fmt.Errorf("unsupported fusion %q, must be %s or %s", req.Fusion,
+			fusionReciprocalRank, fusionBlend)
+	}
+
+	distancer, err := newDistanceProvider(g.metric())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	distances := make(map[int]float32, len(vector))
+	for _, res := range vector {
+		distances[res.id] = res.distance
+	}
+
+	size := min(len(fused), controls.k)
+	res := make([]searchResult, size)
+	scores := make([]float32, size)
+	for i, elem := range fused[:size] {
+		dist, ok := distances[elem.id]
+		if !ok {
+			dist = distancer.distance(queryVector, g.vectorOf(elem.id))
+		}
+
+		res[i] = searchResult{id: elem.id, distance: dist}
+		scores[i] = elem.score
+	}
+
+	return res, scores, nil
+}
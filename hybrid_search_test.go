@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestFusion(t *testing.T) {
+	vector := []searchResult{{id: 1, distance: 0.1}, {id: 2, distance: 0.2}, {id: 3, distance: 0.5}}
+	keyword := []textResult{{id: 3, score: 9}, {id: 4, score: 3}, {id: 1, score: 1}}
+
+	rrf := fuseReciprocalRank(vector, keyword)
+	if len(rrf) != 4 || rrf[0].id != 1 || rrf[1].id != 3 || rrf[2].id != 2 || rrf[3].id != 4 {
+		t.Errorf("expected 1, 3, 2, 4, got %v", rrf)
+	}
+
+	if expected := 1/float32(61) + 1/float32(63); rrf[0].score != expected {
+		t.Errorf("expected a score of %f, got %f", expected, rrf[0].score)
+	}
+
+	for _, test := range []struct {
+		alpha float32
+		first int
+	}{{1, 1}, {0, 3}, {0.3, 3}} {
+		blend := fuseBlend(vector, keyword, test.alpha)
+		if len(blend) != 4 || blend[0].id != test.first {
+			t.Errorf("alpha %f: expected %d first, got %v", test.alpha, test.first, blend)
+		}
+	}
+}
+
+func TestHybridSearch(t *testing.T) {
+	m = newMonitoring()
+
+	vectors := randomVectors(rand.New(rand.NewSource(7)), 100, vectorDimensions)
+	ids, err := newIDMapping(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	properties, err := newPropertyStore(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index := newFlatIndex(flatConfig{}, func(id int) []float32 { return vectors[id] })
+	for i := range vectors {
+		if _, err := ids.add(fmt.Sprintf("object-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+		index.add(i)
+	}
+
+	if err := properties.set(42, map[string]interface{}{"code": "XB-400a", "stock": 3.0}); err != nil {
+		t.Fatal(err)
+	}
+	h := newHandlers(index, nil, ids, properties, newTextIndexFrom(ids, properties, index))
+
+	var nearest []int
+	for _, res := range index.knnSearchByVectorWithBudget(vectors[0], 5, 5, nil, nil) {
+		nearest = append(nearest, res.id)
+	}
+	if containsInt(nearest, 42) {
+		t.Fatal("test setup: the object with the code must not be a nearest neighbor")
+	}
+
+	t.Run("keywords find what the vector misses", func(t *testing.T) {
+		for _, fusion := range []string{"", fusionReciprocalRank, fusionBlend} {
+			list, err := h.search(searchRequest{Name: "object-0", Size: 5, Query: "xb-400a",
+				Fusion: fusion})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			found := false
+			for _, res := range list.Results {
+				if res.Score == nil {
+					t.Errorf("fusion %q: expected a score for %v", fusion, res.Object)
+				}
+
+				if res.Object == "object-42" {
+					found = true
+					expected := cosineDistancer{}.distance(vectors[0], vectors[42])
+					if diff := res.Distance - expected; diff > 1e-5 || diff < -1e-5 {
+						t.Errorf("expected the actual distance %f, got %f", expected, res.Distance)
+					}
+				}
+			}
+
+			if !found {
+				t.Errorf("fusion %q: expected object-42 in %v", fusion, list.Results)
+			}
+		}
+	})
+
+	t.Run("filters apply to keywords", func(t *testing.T) {
+		where, err := parseFilter([]byte(`{"property": "stock", "equals": 0}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		list, err := h.search(searchRequest{Name: "object-0", Query: "xb-400a", Where: where})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(list.Results) != 0 {
+			t.Errorf("expected no results, got %v", list.Results)
+		}
+	})
+
+	t.Run("invalid requests", func(t *testing.T) {
+		alpha := float32(2)
+		maxDistance := float32(0.5)
+		for _, req := range []searchRequest{
+			{Name: "object-0", Query: "x", Fusion: "max"},
+			{Name: "object-0", Query: "x", Fusion: fusionBlend, Alpha: &alpha},
+			{Name: "object-0", Query: "x", MaxDistance: &maxDistance},
+			{Name: "object-0", Fusion: fusionBlend},
+		} {
+			if _, err := h.search(req); err == nil {
+				t.Errorf("expected an error for %+v", req)
+			}
+		}
+	})
+
+	t.Run("deleted objects are not indexed again", func(t *testing.T) {
+		if err := index.delete(42); err != nil {
+			t.Fatal(err)
+		}
+
+		if results := newTextIndexFrom(ids, properties, index).search("xb-400a", 5, nil); len(results) != 0 {
+			t.Errorf("expected no results, got %v", results)
+		}
+	})
+}
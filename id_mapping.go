@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	externalToInternalBucket = []byte("ExternalToInternal")
+	internalToExternalBucket = []byte("InternalToExternal")
+)
+
+// errObjectNotFound is returned for ids which are not part of the mapping, use
+// errors.Is to check for it
+var errObjectNotFound = errors.New("object not found")
+
+// idMapping is a persistent two-way mapping between the external ids of
+// objects (any non-empty string, such as a UUID) and the internal ids used
+// by the graph and the vector store. Internal ids are handed out
+// sequentially, so they can be used as positions in the node list. Both
+// directions are kept in memory for O(1) lookups, every change is written
+// to bolt before it becomes visible.
+type idMapping struct {
+	sync.RWMutex
+	toInternal map[string]uint32
+	toExternal []string // indexed by internal id
+
+	// nil keeps the mapping in memory only
+	db *bolt.DB
+}
+
+// newIDMapping loads the existing mapping from db, a nil db results in an
+// empty in-memory mapping
+func newIDMapping(db *bolt.DB) (*idMapping, error) {
+	ids := &idMapping{toInternal: map[string]uint32{}, db: db}
+	if db == nil {
+		return ids, nil
+	}
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(externalToInternalBucket); err != nil {
+			return err
+		}
+
+		b, err := tx.CreateBucketIfNotExists(internalToExternalBucket)
+		if err != nil {
+			return err
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			ids.setInMemory(string(v), binary.BigEndian.Uint32(k))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("load id mapping: %v", err)
+	}
+
+	return ids, nil
+}
+
+// add returns the internal id of the object and assigns the next free one if
+// the object is not known yet
+func (ids *idMapping) add(external string) (uint32, error) {
+	internal, err := ids.addAll([]string{external})
+	if err != nil {
+		return 0, err
+	}
+
+	return internal[0], nil
+}
+
+// addAll is add for many objects at once. All new ids are stored in a single
+// transaction, so importing in batches is a lot faster than one by one. If
+// an error is returned, none of the objects were added.
+func (ids *idMapping) addAll(externals []string) ([]uint32, error) {
+	for _, external := range externals {
+		if external == "" {
+			return nil, fmt.Errorf("external id must not be empty")
+		}
+	}
+
+	ids.Lock()
+	defer ids.Unlock()
+
+	out := make([]uint32, len(externals))
+	added := map[string]uint32{}
+	var newExternals []string
+	next := uint32(len(ids.toExternal))
+	for i, external := range externals {
+		if internal, ok := ids.toInternal[external]; ok {
+			out[i] = internal
+			continue
+		}
+
+		// the same object can occur more than once in a batch
+		if internal, ok := added[external]; ok {
+			out[i] = internal
+			continue
+		}
+
+		added[external] = next
+		newExternals = append(newExternals, external)
+		out[i] = next
+		next++
+	}
+
+	if ids.db != nil && len(newExternals) > 0 {
+		err := ids.db.Update(func(tx *bolt.Tx) error {
+			for _, external := range newExternals {
+				key := make([]byte, 4)
+				binary.BigEndian.PutUint32(key, added[external])
+
+				if err := tx.Bucket(externalToInternalBucket).Put([]byte(external), key); err != nil {
+					return err
+				}
+
+				if err := tx.Bucket(internalToExternalBucket).Put(key, []byte(external)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("store id mapping of %d objects: %v", len(newExternals), err)
+		}
+	}
+
+	for _, external := range newExternals {
+		ids.setInMemory(external, added[external])
+	}
+	return out, nil
+}
+
+func (ids *idMapping) setInMemory(external string, internal uint32) {
+	for int(internal) >= len(ids.toExternal) {
+		ids.toExternal = append(ids.toExternal, "")
+	}
+
+	ids.toExternal[internal] = external
+	ids.toInternal[external] = internal
+}
+
+func (ids *idMapping) internalID(external string) (uint32, error) {
+	ids.RLock()
+	defer ids.RUnlock()
+
+	internal, ok := ids.toInternal[external]
+	if !ok {
+		return 0, fmt.Errorf("%w: no object with id %q", errObjectNotFound, external)
+	}
+
+	return internal, nil
+}
+
+func (ids *idMapping) externalID(internal uint32) (string, error) {
+	ids.RLock()
+	defer ids.RUnlock()
+
+	if int(internal) >= len(ids.toExternal) || ids.toExternal[internal] == "" {
+		return "", fmt.Errorf("%w: no object with internal id %d", errObjectNotFound, internal)
+	}
+
+	return ids.toExternal[internal], nil
+}
+
+func (ids *idMapping) len() int {
+	ids.RLock()
+	defer ids.RUnlock()
+
+	return len(ids.toInternal)
+}
+
+// nextInternalID is larger than every internal id in use. It can be larger
+// than len, because the internal ids of a legacy mapping can have gaps.
+func (ids *idMapping) nextInternalID() int {
+	ids.RLock()
+	defer ids.RUnlock()
+
+	return len(ids.toExternal)
+}
+
+// importLegacyMapping reads an object_to_index.json written by earlier
+// versions, which mapped names to line numbers of the vectors file. The line
+// numbers are kept as internal ids, so existing indexes stay valid.
+func (ids *idMapping) importLegacyMapping(path string) error {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read legacy mapping: %v", err)
+	}
+
+	var legacy map[string]int
+	if err := json.Unmarshal(bytes, &legacy); err != nil {
+		return fmt.Errorf("parse legacy mapping: %v", err)
+	}
+
+	ids.Lock()
+	defer ids.Unlock()
+
+	if ids.db != nil {
+		err := ids.db.Update(func(tx *bolt.Tx) error {
+			for external, internal := range legacy {
+				key := make([]byte, 4)
+				binary.BigEndian.PutUint32(key, uint32(internal))
+
+				if err := tx.Bucket(externalToInternalBucket).Put([]byte(external), key); err != nil {
+					return err
+				}
+
+				if err := tx.Bucket(internalToExternalBucket).Put(key, []byte(external)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("store legacy mapping: %v", err)
+		}
+	}
+
+	for external, internal := range legacy {
+		ids.setInMemory(external, uint32(internal))
+	}
+
+	return nil
+}
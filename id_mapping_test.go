@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestIDMapping(t *testing.T) {
+	dir, err := ioutil.TempDir("", "id_mapping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	open := func() (*bolt.DB, *idMapping) {
+		db, err := bolt.Open(filepath.Join(dir, "bolt.db"), 0600, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids, err := newIDMapping(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db, ids
+	}
+
+	db, ids := open()
+	for i, external := range []string{"6f1c3a4e-aaaa", "6f1c3a4e-bbbb", "6f1c3a4e-aaaa"} {
+		internal, err := ids.add(external)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := uint32(i)
+		if i == 2 {
+			// already known
+			expected = 0
+		}
+		if internal != expected {
+			t.Errorf("expected %q to get internal id %d, got %d", external, expected, internal)
+		}
+	}
+
+	if _, err := ids.add(""); err == nil {
+		t.Errorf("expected empty ids to be rejected")
+	}
+
+	if _, err := ids.internalID("unknown"); !errors.Is(err, errObjectNotFound) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+
+	if _, err := ids.externalID(17); !errors.Is(err, errObjectNotFound) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+	db.Close()
+
+	t.Run("reopening", func(t *testing.T) {
+		db, ids := open()
+		defer db.Close()
+
+		if ids.len() != 2 {
+			t.Fatalf("expected 2 ids, got %d", ids.len())
+		}
+
+		if internal, err := ids.internalID("6f1c3a4e-bbbb"); err != nil || internal != 1 {
+			t.Errorf("expected internal id 1, got %d (%v)", internal, err)
+		}
+
+		if external, err := ids.externalID(0); err != nil || external != "6f1c3a4e-aaaa" {
+			t.Errorf("expected external id 6f1c3a4e-aaaa, got %q (%v)", external, err)
+		}
+
+		if internal, _ := ids.add("6f1c3a4e-cccc"); internal != 2 {
+			t.Errorf("expected the next free internal id 2, got %d", internal)
+		}
+	})
+
+	t.Run("adding in batches", func(t *testing.T) {
+		db, ids := open()
+		defer db.Close()
+
+		if _, err := ids.addAll([]string{"6f1c3a4e-dddd", ""}); err == nil {
+			t.Errorf("expected a batch with an empty id to be rejected")
+		}
+
+		internal, err := ids.addAll([]string{"6f1c3a4e-eeee", "6f1c3a4e-aaaa", "6f1c3a4e-eeee"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(internal, []uint32{3, 0, 3}) {
+			t.Errorf("expected internal ids [3 0 3], got %v", internal)
+		}
+
+		if _, err := ids.internalID("6f1c3a4e-dddd"); !errors.Is(err, errObjectNotFound) {
+			t.Errorf("expected nothing of the rejected batch to be added, got %v", err)
+		}
+	})
+
+	t.Run("importing the legacy mapping", func(t *testing.T) {
+		path := filepath.Join(dir, "object_to_index.json")
+		if err := ioutil.WriteFile(path, []byte(`{"apple": 0, "pear": 3}`), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		ids, _ := newIDMapping(nil)
+		if err := ids.importLegacyMapping(path); err != nil {
+			t.Fatal(err)
+		}
+
+		if external, err := ids.externalID(3); err != nil || external != "pear" {
+			t.Errorf("expected pear, got %q (%v)", external, err)
+		}
+
+		if _, err := ids.externalID(1); !errors.Is(err, errObjectNotFound) {
+			t.Errorf("expected gaps to be unknown, got %v", err)
+		}
+
+		if ids.len() != 2 || ids.nextInternalID() != 4 {
+			t.Errorf("expected 2 ids up to 4, got %d up to %d", ids.len(), ids.nextInternalID())
+		}
+
+		if internal, _ := ids.add("plum"); internal != 4 {
+			t.Errorf("expected plum to be added after the legacy ids, got %d", internal)
+		}
+	})
+}
@@ -10,6 +10,8 @@ import (
 	"net/http"
 	"os"
 	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -45,6 +47,21 @@ func (v *vertex) String() string {
 
 var k = 36
 var vectorsFile = "./vectors-shuf.txt"
+var tombstoneCleanupInterval = 30 * time.Second
+
+const (
+	indexPath = "./data/hnsw.index"
+
+	// suffixed with the id of the index, see commitLogPathFor
+	commitLogPath = "./data/hnsw_commit_log"
+
+	// written by earlier versions, see idMapping.importLegacyMapping
+	legacyMappingPath = "./data/object_to_index.json"
+
+	// number of objects whose ids are stored in a single transaction when
+	// importing the vectors file
+	importBatchSize = 1000
+)
 
 type job struct {
 	index  int64
@@ -58,7 +75,8 @@ func nswWorker(graph *nsw, workerid int, jobs chan job) {
 	}
 }
 
-func hnswWorker(primary, secondary *hnsw, workerid int, jobs chan job) {
+func hnswWorker(primary, secondary *hnsw, workerid int, jobs chan job, wg *sync.WaitGroup) {
+	defer wg.Done()
 	for job := range jobs {
 		before := time.Now()
 		err := storeToBolt(job.index, job.vector)
@@ -68,7 +86,7 @@ func hnswWorker(primary, secondary *hnsw, workerid int, jobs chan job) {
 		m.addWritingDisk(before)
 
 		var graph *hnsw
-		if rand.Float32() < 0.5 {
+		if flagDeterministic || rand.Float32() < 0.5 {
 			graph = primary
 		} else {
 			graph = secondary
@@ -87,19 +105,69 @@ func initBolt() {
 	}
 	db = boltdb
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte("Vectors"))
-		if err != nil {
-			return fmt.Errorf("create bucket: %s", err)
+	if err := createVectorBuckets(db); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func createVectorBuckets(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{"Vectors", "NormalizedVectors"} {
+			_, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return fmt.Errorf("create bucket: %s", err)
+			}
 		}
 		return nil
 	})
-	if err != nil {
-		log.Fatal(err)
-	}
 }
 
 var flagBenchmarkElastic bool
+var flagDistanceMetric = metricCosine
+
+// flagMonitorDistancing times every distance calculation and the vector cache
+// reads behind it. This takes the monitoring lock on the hottest path, so it
+// is off unless asked for.
+var flagMonitorDistancing bool
+
+// flagVerify checks the index instead of serving it, it is one of
+// verifySourceAuto, verifySourceIndex and verifySourceCommitLog
+var flagVerify string
+
+// flagEvaluate measures recall, latency and cost of the loaded index over a
+// sweep of ef values instead of serving it
+var flagEvaluate bool
+var flagEvaluateQueries = 100
+var flagEvaluateK = 10
+var flagEvaluateEfs = []int{16, 32, 64, 128, 256, 512}
+
+// flagPQSegments compresses the loaded indexes with product quantization,
+// flagScalarQuantization with int8 scalar quantization and
+// flagBinaryQuantization with a single bit per dimension. flagCompressionSample
+// is the number of vectors the compressor is trained on, flagBQOversampling
+// the factor by which binary quantized searches oversample before rescoring.
+var flagPQSegments int
+var flagScalarQuantization bool
+var flagBinaryQuantization bool
+var flagCompressionSample = 10000
+var flagBQOversampling = 4
+
+// flagFlatThreshold builds a flat index instead of the graphs, which is
+// promoted to a graph once it holds this many vectors
+var flagFlatThreshold int
+
+// flagDeterministic builds the index on a single worker and only inserts into
+// the primary index, so that the same seed and input lead to the same file
+var flagDeterministic bool
+var flagSeed int64
+var flagSeedSet bool
+
+// flagEf is the ef of queries which don't set their own
+var flagEf = 100
+
+// flagMaxEf is the upper limit for both ef and size of a single query
+var flagMaxEf = 1000
+
 var m *monitoring
 
 func parseFlags() {
@@ -109,6 +177,109 @@ func parseFlags() {
 			fmt.Println("benchmarking against elasticsearch fast-vector score plugin")
 			flagBenchmarkElastic = true
 		}
+
+		if strings.HasPrefix(flag, "distance=") {
+			metric, err := parseDistanceMetric(strings.TrimPrefix(flag, "distance="))
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("using %s distance\n", metric)
+			flagDistanceMetric = metric
+		}
+
+		for _, intFlag := range []struct {
+			prefix string
+			target *int
+		}{{"ef=", &flagEf}, {"max-ef=", &flagMaxEf},
+			{"evaluate-queries=", &flagEvaluateQueries}, {"evaluate-k=", &flagEvaluateK},
+			{"pq=", &flagPQSegments}, {"compression-sample=", &flagCompressionSample},
+			{"bq-oversampling=", &flagBQOversampling}, {"flat=", &flagFlatThreshold}} {
+			if strings.HasPrefix(flag, intFlag.prefix) {
+				value, err := strconv.Atoi(strings.TrimPrefix(flag, intFlag.prefix))
+				if err != nil || value < 1 {
+					log.Fatalf("invalid %s%s, must be a positive integer", intFlag.prefix,
+						strings.TrimPrefix(flag, intFlag.prefix))
+				}
+				*intFlag.target = value
+			}
+		}
+
+		if flag == "monitor-distance" {
+			fmt.Println("monitoring distance calculations")
+			flagMonitorDistancing = true
+		}
+
+		if flag == "sq" {
+			flagScalarQuantization = true
+		}
+
+		if flag == "bq" {
+			flagBinaryQuantization = true
+		}
+
+		if flag == "evaluate" {
+			flagEvaluate = true
+		}
+
+		if strings.HasPrefix(flag, "evaluate-ef=") {
+			flagEvaluateEfs = nil
+			for _, str := range strings.Split(strings.TrimPrefix(flag, "evaluate-ef="), ",") {
+				ef, err := strconv.Atoi(str)
+				if err != nil || ef < 1 {
+					log.Fatalf("invalid evaluate-ef %q, must be a list of positive integers", str)
+				}
+				flagEvaluateEfs = append(flagEvaluateEfs, ef)
+			}
+		}
+
+		if flag == "verify" {
+			flagVerify = verifySourceAuto
+		}
+
+		if strings.HasPrefix(flag, "verify=") {
+			flagVerify = strings.TrimPrefix(flag, "verify=")
+			if flagVerify != verifySourceIndex && flagVerify != verifySourceCommitLog {
+				log.Fatalf("invalid verify=%s, must be %s or %s", flagVerify,
+					verifySourceIndex, verifySourceCommitLog)
+			}
+		}
+
+		if flag == "deterministic" {
+			fmt.Println("building deterministically on a single worker")
+			flagDeterministic = true
+		}
+
+		if strings.HasPrefix(flag, "seed=") {
+			seed, err := strconv.ParseInt(strings.TrimPrefix(flag, "seed="), 10, 64)
+			if err != nil {
+				log.Fatalf("invalid seed: %v", err)
+			}
+			flagSeed = seed
+			flagSeedSet = true
+		}
+	}
+
+	compressors := 0
+	for _, enabled := range []bool{flagPQSegments > 0, flagScalarQuantization,
+		flagBinaryQuantization} {
+		if enabled {
+			compressors++
+		}
+	}
+	if compressors > 1 {
+		log.Fatal("only one of pq, sq and bq can be used")
+	}
+
+	if flagFlatThreshold > 0 && (compressors > 0 || flagEvaluate) {
+		log.Fatal("a flat index can neither be compressed nor evaluated")
+	}
+
+	if flagEf > flagMaxEf {
+		log.Fatalf("ef=%d must not be larger than max-ef=%d", flagEf, flagMaxEf)
+	}
+
+	if !flagSeedSet && !flagDeterministic {
+		flagSeed = time.Now().UnixNano()
 	}
 }
 
@@ -134,16 +305,32 @@ var cache = newCache()
 func main() {
 	startup := time.Now()
 	m = newMonitoring()
+	parseFlags()
+	if flagVerify != "" {
+		os.Exit(runVerify(flagVerify, os.Stdout))
+	}
+	fmt.Printf("using %s distance kernels\n", distanceKernels)
+
 	initBolt()
 	defer db.Close()
 
+	ids, err := newIDMapping(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	properties, err := newPropertyStore(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	var g = &hnsw{}
 	var secondary *hnsw
-	var wordToIndex map[string]int
+	var index vectorIndex = g
 
-	if fileExists("./data/hnsw.index") {
+	if fileExists(indexPath) {
 		// read hnsw index
-		f, err := os.Open("./data/hnsw.index")
+		f, err := os.Open(indexPath)
 		if err != nil {
 			log.Fatal(err.Error())
 		}
@@ -157,6 +344,32 @@ func main() {
 		if err != nil {
 			log.Fatal(err.Error())
 		}
+		g.id = "primary"
+
+		// the index file is only written when it is built and on every start,
+		// all changes since then are in the commit log
+		logPath := commitLogPathFor(g.id)
+		if fileExists(logPath) {
+			if err := replayCommitLogFile(logPath, g); err != nil {
+				log.Printf("restoring changes from %s: %v", logPath, err)
+			}
+		}
+
+		// the replayed changes are part of the index file from now on, so the
+		// log can start over
+		if err := writeIndexFile(g, indexPath); err != nil {
+			log.Fatal(err)
+		}
+		g.commitLog = newHnswCommitLogger(logPath)
+		// the seed is not part of the index file, levels of new nodes follow
+		// the configured one just like in a fresh build
+		g.randomSource = rand.New(rand.NewSource(flagSeed))
+		if g.distancer.metric() == metricCosine {
+			g.distancer = useNormalizedCosine()
+			if err := storeMissingNormalizedVectors(); err != nil {
+				log.Fatal(err)
+			}
+		}
 
 		g.vectorForID = func(i int) []float32 {
 			return cache.get(i)
@@ -170,63 +383,63 @@ func main() {
 
 		f.Close()
 
-		// read wordToIndex
-		f, err = os.Open("./data/object_to_index.json")
-		if err != nil {
-			log.Fatal(err.Error())
-		}
-
-		bytes, err = ioutil.ReadAll(f)
-		if err != nil {
-			log.Fatal(err.Error())
-		}
-
-		err = json.Unmarshal(bytes, &wordToIndex)
-		if err != nil {
-			log.Fatal(err.Error())
+		if ids.len() == 0 && fileExists(legacyMappingPath) {
+			fmt.Println("importing object ids from " + legacyMappingPath)
+			if err := ids.importLegacyMapping(legacyMappingPath); err != nil {
+				log.Fatal(err)
+			}
 		}
 
+	} else if flagFlatThreshold > 0 {
+		index = buildFlatIndex(ids)
 	} else {
 		// build new
-		g, secondary, wordToIndex = buildNewIndex()
-
+		g, secondary = buildNewIndex(ids)
+		index = g
 	}
 
-	getIndex := func(name string) int64 {
-		return int64(wordToIndex[name])
+	if index == g {
+		compressIndexes(g, secondary)
 	}
 
-	getData := func(index int64) string {
-		// TODO: this can obviously be improved
-
-		for key, value := range wordToIndex {
-			if value == int(index) {
-				return key
-			}
-		}
+	if flagEvaluate {
+		queries := g.sampleQueries(rand.New(rand.NewSource(flagSeed)), flagEvaluateQueries)
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(g.evaluate(queries, flagEvaluateK, flagEvaluateEfs))
+		return
+	}
 
-		return ""
+	var secondaryIndex vectorIndex
+	if index == g {
+		g.startTombstoneCleanup(tombstoneCleanupInterval)
+	}
+	if secondary != nil {
+		secondary.startTombstoneCleanup(tombstoneCleanupInterval)
+		secondaryIndex = secondary
 	}
 
-	handler := newHandlers(g, secondary, getIndex, getData)
-	http.Handle("/objects", http.HandlerFunc(handler.getObjects))
+	handler := newHandlers(index, secondaryIndex, ids, properties,
+		newTextIndexFrom(ids, properties, index))
+	http.Handle("/objects", http.HandlerFunc(handler.objects))
+	http.Handle("/search", http.HandlerFunc(handler.searchByVector))
+	http.Handle("/search/batch", http.HandlerFunc(handler.batchSearch))
 	fmt.Printf("Startup took %s, Listening on :8080\n", time.Since(startup))
 
-	err := http.ListenAndServe(":8080", nil)
+	err = http.ListenAndServe(":8080", nil)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 }
 
-func buildNewIndex() (*hnsw, *hnsw, map[string]int) {
+func buildNewIndex(ids *idMapping) (*hnsw, *hnsw) {
 	m.reset()
 
 	limit := 1000
 
-	parseFlags()
-
 	rand.Seed(time.Now().UnixNano())
+	fmt.Printf("building with seed %d\n", flagSeed)
 	if flagBenchmarkElastic {
 		err := setMappings()
 		if err != nil {
@@ -254,8 +467,19 @@ func buildNewIndex() (*hnsw, *hnsw, map[string]int) {
 	// }
 	// wordToIndex := parseVectorsFromFile(vectorsFile, limit, insertFn)
 
+	distancer, err := newDistanceProvider(flagDistanceMetric)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if flagDistanceMetric == metricCosine {
+		distancer = useNormalizedCosine()
+	}
+
+	cfg := indexConfig(distancer)
+
 	// g := &nsw{}
-	g := newHnsw("primary", 30, 60, func(i int) []float32 {
+	g := newHnsw("primary", cfg, func(i int) []float32 {
 		// vec, err := readVectorFromBolt(int64(i))
 		// if err != nil {
 		// 	log.Fatalf(err.Error())
@@ -265,7 +489,7 @@ func buildNewIndex() (*hnsw, *hnsw, map[string]int) {
 		return cache.get(i)
 	})
 
-	secondary := newHnsw("secondary", 30, 60, cache.get)
+	secondary := newHnsw("secondary", cfg, cache.get)
 
 	g.insertHook = func(nodeId, targetLevel int, neighborsAtLevel map[int][]uint32) {
 		secondary.insertFromExternal(nodeId, targetLevel, neighborsAtLevel)
@@ -281,15 +505,21 @@ func buildNewIndex() (*hnsw, *hnsw, map[string]int) {
 	fmt.Printf("building index")
 	jobs := make(chan job)
 	numWorkers := runtime.GOMAXPROCS(0)
+	if flagDeterministic {
+		// the order of inserts is only predictable on a single worker
+		numWorkers = 1
+	}
+	wg := &sync.WaitGroup{}
 	for i := 0; i < numWorkers; i++ {
 		fmt.Printf("starting worker %d\n", i)
 		// go nswWorker(g, i, jobs)
-		go hnswWorker(g, secondary, i, jobs)
+		wg.Add(1)
+		go hnswWorker(g, secondary, i, jobs, wg)
 	}
 
 	start := time.Now()
-	indexFn := func(i int, word string, vector []float32) {
-		jobs <- job{object: word, index: int64(i), vector: vector}
+	indexFn := func(i int, word string, id uint32, vector []float32) {
+		jobs <- job{object: word, index: int64(id), vector: vector}
 
 		if i%100 == 0 {
 			// technically we're measuring the time between jobs we start, not jobs
@@ -300,54 +530,85 @@ func buildNewIndex() (*hnsw, *hnsw, map[string]int) {
 		}
 
 	}
-	wordToIndex := parseVectorsFromFile(vectorsFile, limit, indexFn)
+	parseVectorBatchesFromFile(vectorsFile, limit, importBatchSize, func(first int, words []string, vectors [][]float32) {
+		batch, err := ids.addAll(words)
+		if err != nil {
+			log.Printf("skipping %d objects: %v\n", len(words), err)
+			return
+		}
+
+		for i, id := range batch {
+			indexFn(first+i, words[i], id, vectors[i])
+		}
+	})
+	close(jobs)
+	wg.Wait()
 
-	// let remaining workers finish and everything calm down
+	// let the replication to the other index calm down
 
 	time.Sleep(3 * time.Second)
 
-	bytes, err := g.MarshalGzip()
-	if err != nil {
+	if err := writeIndexFile(g, indexPath); err != nil {
 		log.Printf(err.Error())
+	} else {
+		// the log only holds the changes which are not part of the file
+		g.commitLog.Truncate()
 	}
 
-	f, err := os.Create("./data/hnsw.index")
-	if err != nil {
-		log.Printf(err.Error())
-	}
+	m.writeTimes(os.Stdout)
 
-	_, err = f.Write(bytes)
-	if err != nil {
-		log.Printf(err.Error())
-	}
+	fmt.Println("primary:")
+	g.Stats()
+	fmt.Println("secondary:")
+	secondary.Stats()
 
-	f.Close()
+	return g, secondary
+}
 
-	bytes, err = json.Marshal(wordToIndex)
+// buildFlatIndex imports the vectors into a flat index, which is promoted to
+// a graph in the background once it passes flagFlatThreshold. Neither index
+// is written to indexPath, they are rebuilt from the vectors on every start.
+func buildFlatIndex(ids *idMapping) *flatIndex {
+	distancer, err := newDistanceProvider(flagDistanceMetric)
 	if err != nil {
-		log.Printf(err.Error())
+		log.Fatal(err)
 	}
 
-	f, err = os.Create("./data/object_to_index.json")
-	if err != nil {
-		log.Printf(err.Error())
+	if flagDistanceMetric == metricCosine {
+		distancer = useNormalizedCosine()
 	}
 
-	_, err = f.Write(bytes)
-	if err != nil {
-		log.Printf(err.Error())
-	}
-
-	f.Close()
+	index := newFlatIndex(flatConfig{
+		distancer:          distancer,
+		promotionThreshold: flagFlatThreshold,
+		newGraph: func() *hnsw {
+			g := newHnsw("primary", indexConfig(distancer), cache.get)
+			g.startTombstoneCleanup(tombstoneCleanupInterval)
+			return g
+		},
+	}, cache.get)
+
+	fmt.Printf("building flat index, promoting it to a graph at %d vectors\n", flagFlatThreshold)
+	before := time.Now()
+	parseVectorBatchesFromFile(vectorsFile, 1000, importBatchSize, func(first int, words []string, vectors [][]float32) {
+		batch, err := ids.addAll(words)
+		if err != nil {
+			log.Printf("skipping %d objects: %v\n", len(words), err)
+			return
+		}
 
-	m.writeTimes(os.Stdout)
+		for i, id := range batch {
+			if err := storeToBolt(int64(id), vectors[i]); err != nil {
+				log.Printf("bolt error: %v\n", err)
+				continue
+			}
 
-	fmt.Println("primary:")
-	g.Stats()
-	fmt.Println("secondary:")
-	secondary.Stats()
+			index.add(int(id))
+		}
+	})
+	fmt.Printf("built flat index in %s\n", time.Since(before))
 
-	return g, secondary, wordToIndex
+	return index
 }
 
 type vertexWithDistance struct {
@@ -360,24 +621,17 @@ func cosineSim(a, b []float32) (float32, error) {
 		return 0, fmt.Errorf("vectors have different dimensions")
 	}
 
-	var (
-		sumProduct float64
-		sumASquare float64
-		sumBSquare float64
-	)
-
-	for i := range a {
-		sumProduct += float64(a[i] * b[i])
-		sumASquare += float64(a[i] * a[i])
-		sumBSquare += float64(b[i] * b[i])
-	}
+	sumProduct := float64(dotProductImpl(a, b))
+	sumASquare := float64(dotProductImpl(a, a))
+	sumBSquare := float64(dotProductImpl(b, b))
 
 	return float32(sumProduct / (math.Sqrt(sumASquare) * math.Sqrt(sumBSquare))), nil
 }
 
 func cosineDist(a, b []float32) float32 {
-	before := time.Now()
-	defer m.addDistancing(before)
+	if flagMonitorDistancing {
+		defer m.addDistancing(time.Now())
+	}
 	sim, err := cosineSim(a, b)
 	if err != nil {
 		panic(err)
@@ -386,6 +640,78 @@ func cosineDist(a, b []float32) float32 {
 	return 1 - sim
 }
 
+// compressIndexes trains the compressor selected by the flags on a sample of
+// the primary index and compresses all indexes with it. Without a compression
+// flag it does nothing.
+func compressIndexes(primary, secondary *hnsw) {
+	if flagPQSegments == 0 && !flagScalarQuantization && !flagBinaryQuantization {
+		return
+	}
+
+	before := time.Now()
+	r := rand.New(rand.NewSource(flagSeed))
+	sample := primary.sampleQueries(r, flagCompressionSample)
+	metric := primary.distancer.metric()
+
+	var compressor, secondaryCompressor vectorCompressor
+	switch {
+	case flagPQSegments > 0:
+		pq, err := trainProductQuantizer(sample, metric, flagPQSegments, r)
+		if err != nil {
+			log.Fatal(err)
+		}
+		compressor, secondaryCompressor = pq, pq.withoutCodes()
+		fmt.Printf("trained product quantizer with %d segments", flagPQSegments)
+	case flagScalarQuantization:
+		sq, err := trainScalarQuantizer(sample, metric)
+		if err != nil {
+			log.Fatal(err)
+		}
+		compressor, secondaryCompressor = sq, sq.withoutCodes()
+		fmt.Printf("calibrated scalar quantizer")
+	case flagBinaryQuantization:
+		if len(sample) == 0 {
+			log.Fatal("binary quantization needs at least one vector in the index")
+		}
+		bq, err := newBinaryQuantizer(len(sample[0]), flagBQOversampling)
+		if err != nil {
+			log.Fatal(err)
+		}
+		compressor, secondaryCompressor = bq, bq.withoutCodes()
+		fmt.Printf("set up binary quantizer with %dx oversampling", flagBQOversampling)
+	}
+	fmt.Printf(" on %d vectors in %s\n", len(sample), time.Since(before))
+
+	before = time.Now()
+	primary.compress(compressor)
+	if secondary != nil {
+		secondary.compress(secondaryCompressor)
+	}
+	fmt.Printf("compressed indexes in %s\n", time.Since(before))
+}
+
+// indexConfig is used for every index this server builds
+func indexConfig(distancer distanceProvider) hnswConfig {
+	return hnswConfig{
+		maximumConnections: 30,
+		efConstruction:     60,
+		neighborSelection: neighborSelection{
+			algorithm:             neighborSelectionHeuristic,
+			keepPrunedConnections: true,
+		},
+		distancer:  distancer,
+		randomSeed: flagSeed,
+	}
+}
+
+// useNormalizedCosine makes the cache serve unit-length vectors and returns
+// the distancer which relies on them. It must be called before the first
+// vector is stored or read through the cache.
+func useNormalizedCosine() distanceProvider {
+	cache.normalize = true
+	return normalizedCosineDistancer{}
+}
+
 func fileExists(filename string) bool {
 	info, err := os.Stat(filename)
 	if os.IsNotExist(err) {
@@ -9,6 +9,17 @@ import (
 type nsw struct {
 	sync.RWMutex
 	vertices []*vertex
+
+	// defaults to cosine distance if nil
+	distancer distanceProvider
+}
+
+func (g *nsw) distance(a, b []float32) float32 {
+	if g.distancer == nil {
+		return cosineDist(a, b)
+	}
+
+	return g.distancer.distance(a, b)
 }
 
 func (g *nsw) insert(vertexToInsert *vertex, k int) {
@@ -42,7 +53,7 @@ func (g *nsw) insert(vertexToInsert *vertex, k int) {
 		return
 	}
 
-	neighbors := g.knnSearch(vertexToInsert, 1, k, false)
+	neighbors := g.knnSearch(vertexToInsert, 1, k, nil)
 	for _, neighbor := range neighbors {
 		neighbor.vertex.Lock()
 		neighbor.vertex.edges = append(neighbor.vertex.edges, vertexToInsert)
@@ -67,7 +78,7 @@ func (g *nsw) print() {
 	}
 }
 
-func (g *nsw) knnSearch(queryObj *vertex, maximumSearches int, k int, filter bool) []vertexWithDistance {
+func (g *nsw) knnSearch(queryObj *vertex, maximumSearches int, k int, allow allowList) []vertexWithDistance {
 	var (
 		tempRes     = &binarySearchTree{}
 		candidates  = &binarySearchTree{}
@@ -91,7 +102,7 @@ func (g *nsw) knnSearch(queryObj *vertex, maximumSearches int, k int, filter boo
 		entry := g.vertices[rand.Intn(len(g.vertices))]
 		g.RUnlock()
 
-		candidates.insert(entry, cosineDist(getVector(queryObj), getVector(entry)))
+		candidates.insert(entry, g.distance(getVector(queryObj), getVector(entry)))
 
 		hops := 0
 		for {
@@ -111,7 +122,7 @@ func (g *nsw) knnSearch(queryObj *vertex, maximumSearches int, k int, filter boo
 			}
 
 			for _, friend := range candidateData.edges {
-				friendDist := cosineDist(getVector(friend), getVector(queryObj))
+				friendDist := g.distance(getVector(friend), getVector(queryObj))
 				if !visitedSet.contains(friend, friendDist) {
 					visitedSet.insert(friend, friendDist)
 					tempRes.insert(friend, friendDist)
@@ -121,21 +132,16 @@ func (g *nsw) knnSearch(queryObj *vertex, maximumSearches int, k int, filter boo
 		} // end for
 
 		for _, elem := range tempRes.flattenInOrder() {
-			// being attempt to filter
-			if filter {
-				if elem.data.object[0] != "a"[0] {
-					continue
-				}
+			if allow != nil && !allow.contains(int(elem.data.index)) {
+				continue
 			}
 
-			// end filter
-
 			result.insert(elem.data, elem.dist)
 		}
 	}
 
-	out := make([]vertexWithDistance, k)
 	results := result.flattenInOrder()
+	out := make([]vertexWithDistance, min(k, len(results)))
 	for i := range out {
 		out[i] = vertexWithDistance{
 			vertex:   results[i].data,
@@ -164,10 +170,10 @@ func (g *nsw) search(query []float32, entryPoint *vertex) *vertex {
 	}
 
 	current = entryPoint
-	minDist = cosineDist(getVector(current), query)
+	minDist = g.distance(getVector(current), query)
 
 	for _, friend := range current.edges {
-		friendDist := cosineDist(getVector(friend), query)
+		friendDist := g.distance(getVector(friend), query)
 		if friendDist < minDist {
 			minDist = friendDist
 			next = friend
@@ -8,7 +8,7 @@ import (
 	"strings"
 )
 
-func parseVectorsFromFile(fileName string, limit int, doFn func(i int, word string, vec []float32)) map[string]int {
+func parseVectorsFromFile(fileName string, limit int, doFn func(i int, word string, vec []float32)) {
 	fmt.Println("iterating over input files")
 	file, err := os.Open(fileName)
 	defer file.Close()
@@ -16,7 +16,6 @@ func parseVectorsFromFile(fileName string, limit int, doFn func(i int, word stri
 		panic(err)
 	}
 
-	out := make(map[string]int)
 	scanner := bufio.NewScanner(file)
 	i := 0
 
@@ -27,14 +26,36 @@ func parseVectorsFromFile(fileName string, limit int, doFn func(i int, word stri
 
 		row := scanner.Text()
 		word, vector := parseVectorRow(row)
-		out[word] = i
 
 		doFn(i, word, vector)
 
 		i++
 	}
+}
+
+// parseVectorBatchesFromFile calls doFn with up to size rows at once, first is
+// the row number of the first of them
+func parseVectorBatchesFromFile(fileName string, limit int, size int,
+	doFn func(first int, words []string, vecs [][]float32)) {
+	var words []string
+	var vecs [][]float32
+	first := 0
+	parseVectorsFromFile(fileName, limit, func(i int, word string, vec []float32) {
+		if len(words) == 0 {
+			first = i
+		}
 
-	return out
+		words = append(words, word)
+		vecs = append(vecs, vec)
+		if len(words) == size {
+			doFn(first, words, vecs)
+			words, vecs = nil, nil
+		}
+	})
+
+	if len(words) > 0 {
+		doFn(first, words, vecs)
+	}
 }
 
 func parseVectorRow(row string) (string, []float32) {
@@ -0,0 +1,115 @@
+package main
+
+type priorityQueueItem struct {
+	id   int
+	dist float32
+}
+
+// priorityQueue is a binary heap of ids and their distances. Depending on how
+// it was created either the closest or the furthest item is on top. Contrary
+// to the binary search trees, len is O(1) and the queue never degenerates
+// into a list.
+type priorityQueue struct {
+	items []priorityQueueItem
+	max   bool
+}
+
+// newMinPriorityQueue has the closest item on top, capacity is only a hint
+func newMinPriorityQueue(capacity int) *priorityQueue {
+	return &priorityQueue{items: make([]priorityQueueItem, 0, capacity)}
+}
+
+// newMaxPriorityQueue has the furthest item on top, capacity is only a hint
+func newMaxPriorityQueue(capacity int) *priorityQueue {
+	return &priorityQueue{items: make([]priorityQueueItem, 0, capacity), max: true}
+}
+
+func (q *priorityQueue) len() int {
+	return len(q.items)
+}
+
+func (q *priorityQueue) top() priorityQueueItem {
+	return q.items[0]
+}
+
+func (q *priorityQueue) insert(id int, dist float32) {
+	q.items = append(q.items, priorityQueueItem{id: id, dist: dist})
+	q.up(len(q.items) - 1)
+}
+
+func (q *priorityQueue) pop() priorityQueueItem {
+	out := q.items[0]
+	last := len(q.items) - 1
+	q.items[0] = q.items[last]
+	q.items = q.items[:last]
+	if last > 0 {
+		q.down(0)
+	}
+
+	return out
+}
+
+// sorted returns the items ordered from closest to furthest, the queue itself
+// is not modified
+func (q *priorityQueue) sorted() []priorityQueueItem {
+	tmp := &priorityQueue{
+		items: append(make([]priorityQueueItem, 0, q.len()), q.items...),
+		max:   q.max,
+	}
+
+	out := make([]priorityQueueItem, tmp.len())
+	if tmp.max {
+		for i := len(out) - 1; i >= 0; i-- {
+			out[i] = tmp.pop()
+		}
+	} else {
+		for i := range out {
+			out[i] = tmp.pop()
+		}
+	}
+
+	return out
+}
+
+// before returns true if the item at position a should be closer to the top
+// than the item at position b
+func (q *priorityQueue) before(a, b int) bool {
+	if q.max {
+		return q.items[a].dist > q.items[b].dist
+	}
+
+	return q.items[a].dist < q.items[b].dist
+}
+
+func (q *priorityQueue) up(i int) {
+	for i > 0 {
+		parent := (i - 1) / 2
+		if !q.before(i, parent) {
+			return
+		}
+
+		q.items[i], q.items[parent] = q.items[parent], q.items[i]
+		i = parent
+	}
+}
+
+func (q *priorityQueue) down(i int) {
+	n := len(q.items)
+	for {
+		child := 2*i + 1
+		if child >= n {
+			return
+		}
+
+		if right := child + 1; right < n && q.before(right, child) {
+			child = right
+		}
+
+		if !q.before(child, i) {
+			return
+		}
+
+		q.items[i], q.items[child] = q.items[child], q.items[i]
+		i = child
+	}
+}
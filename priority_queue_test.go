@@ -0,0 +1,119 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestPriorityQueue(t *testing.T) {
+	r := rand.New(rand.NewSource(7))
+	dists := make([]float32, 1000)
+	for i := range dists {
+		dists[i] = r.Float32()
+	}
+
+	expected := append([]float32{}, dists...)
+	sort.Slice(expected, func(a, b int) bool { return expected[a] < expected[b] })
+
+	t.Run("min queue pops closest first", func(t *testing.T) {
+		q := newMinPriorityQueue(0)
+		for i, dist := range dists {
+			q.insert(i, dist)
+		}
+
+		for i := range expected {
+			if item := q.pop(); item.dist != expected[i] {
+				t.Fatalf("position %d: expected %f, got %f", i, expected[i], item.dist)
+			}
+		}
+	})
+
+	t.Run("max queue pops furthest first", func(t *testing.T) {
+		q := newMaxPriorityQueue(0)
+		for i, dist := range dists {
+			q.insert(i, dist)
+		}
+
+		for i := len(expected) - 1; i >= 0; i-- {
+			if item := q.pop(); item.dist != expected[i] {
+				t.Fatalf("position %d: expected %f, got %f", i, expected[i], item.dist)
+			}
+		}
+	})
+
+	t.Run("sorted does not modify the queue", func(t *testing.T) {
+		q := newMaxPriorityQueue(0)
+		for i, dist := range dists {
+			q.insert(i, dist)
+		}
+
+		sorted := q.sorted()
+		for i := range expected {
+			if sorted[i].dist != expected[i] {
+				t.Fatalf("position %d: expected %f, got %f", i, expected[i], sorted[i].dist)
+			}
+		}
+
+		if q.len() != len(dists) {
+			t.Errorf("expected queue to still contain %d items, got %d", len(dists), q.len())
+		}
+	})
+}
+
+// the benchmarks mimic the access pattern of searchLayer: candidates are
+// popped from the closest end, results are capped at ef by dropping the
+// furthest one
+
+func BenchmarkSearchLayerQueues(b *testing.B) {
+	m = newMonitoring()
+
+	r := rand.New(rand.NewSource(7))
+	dists := make([]float32, 5000)
+	for i := range dists {
+		dists[i] = r.Float32()
+	}
+	ef := 100
+
+	b.Run("binary search tree", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			candidates := &binarySearchTreeGeneric{}
+			results := &binarySearchTreeGeneric{}
+			for id, dist := range dists {
+				if results.len() < ef || dist < results.maximum().dist {
+					candidates.insert(id, dist)
+					results.insert(id, dist)
+					if results.len() > ef {
+						max := results.maximum()
+						results.delete(max.index, max.dist)
+					}
+				}
+
+				if id%4 == 0 && candidates.root != nil {
+					min := candidates.minimum()
+					candidates.delete(min.index, min.dist)
+				}
+			}
+		}
+	})
+
+	b.Run("heap", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			candidates := newMinPriorityQueue(ef)
+			results := newMaxPriorityQueue(ef + 1)
+			for id, dist := range dists {
+				if results.len() < ef || dist < results.top().dist {
+					candidates.insert(id, dist)
+					results.insert(id, dist)
+					if results.len() > ef {
+						results.pop()
+					}
+				}
+
+				if id%4 == 0 && candidates.len() > 0 {
+					candidates.pop()
+				}
+			}
+		}
+	})
+}
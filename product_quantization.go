@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// pqMaxCentroids is the number of centroids per segment, so that every code
+// fits into a single byte
+const pqMaxCentroids = 256
+
+const pqTrainingIterations = 20
+
+// productQuantizer splits vectors into segments of equal length and replaces
+// every segment with the id of the closest of up to 256 centroids, which were
+// learned from a sample with k-means. A 600 dimensional vector with 100
+// segments shrinks from 2400 bytes to 100 bytes. Distances to a query are
+// calculated asymmetrically: the query stays uncompressed, its distance to
+// every centroid is calculated once per search and a distance to a node is
+// just the sum of one table lookup per segment.
+type productQuantizer struct {
+	dimensions    int
+	segments      int
+	segmentLength int
+	centroids     int
+	metric        distanceMetric
+	distancer     segmentDistancer
+
+	// codebook[segment][centroid] has segmentLength dimensions
+	codebook [][][]float32
+
+	codes *codeStore
+}
+
+// trainProductQuantizer learns the codebook from sample. The sample should be
+// representative for all vectors which will be encoded, a few thousand
+// vectors are usually enough.
+func trainProductQuantizer(sample [][]float32, metric distanceMetric, segments int,
+	r *rand.Rand) (*productQuantizer, error) {
+	if len(sample) == 0 {
+		return nil, fmt.Errorf("cannot train product quantizer without a sample")
+	}
+
+	dimensions := len(sample[0])
+	if segments < 1 || segments > dimensions || dimensions%segments != 0 {
+		return nil, fmt.Errorf("%d dimensions cannot be split into %d segments of equal length",
+			dimensions, segments)
+	}
+
+	distancer, err := newSegmentDistancer(metric)
+	if err != nil {
+		return nil, err
+	}
+
+	pq := &productQuantizer{
+		dimensions:    dimensions,
+		segments:      segments,
+		segmentLength: dimensions / segments,
+		centroids:     min(pqMaxCentroids, len(sample)),
+		metric:        metric,
+		distancer:     distancer,
+		codebook:      make([][][]float32, segments),
+		codes:         newCodeStore(segments),
+	}
+
+	prepared := make([][]float32, len(sample))
+	for i, vector := range sample {
+		if len(vector) != dimensions {
+			return nil, fmt.Errorf("sample vector %d has %d dimensions, expected %d",
+				i, len(vector), dimensions)
+		}
+		prepared[i] = pq.prepare(vector)
+	}
+
+	for segment := range pq.codebook {
+		points := make([][]float32, len(prepared))
+		for i, vector := range prepared {
+			points[i] = pq.segment(vector, segment)
+		}
+
+		pq.codebook[segment] = kmeans(points, pq.centroids, pqTrainingIterations, r)
+	}
+
+	return pq, nil
+}
+
+func (pq *productQuantizer) withoutCodes() *productQuantizer {
+	copied := *pq
+	copied.codes = newCodeStore(pq.segments)
+	return &copied
+}
+
+func (pq *productQuantizer) prepare(vector []float32) []float32 {
+	return prepareForCompression(pq.metric, vector)
+}
+
+func (pq *productQuantizer) segment(vector []float32, segment int) []float32 {
+	return vector[segment*pq.segmentLength : (segment+1)*pq.segmentLength]
+}
+
+func (pq *productQuantizer) encode(id int, vector []float32) {
+	if len(vector) != pq.dimensions {
+		panic(fmt.Sprintf("product quantizer was trained on %d dimensions, got %d",
+			pq.dimensions, len(vector)))
+	}
+
+	vector = pq.prepare(vector)
+	code := make([]byte, pq.segments)
+	for segment := range code {
+		code[segment] = byte(nearestCentroid(pq.codebook[segment], pq.segment(vector, segment)))
+	}
+
+	pq.codes.set(id, code)
+}
+
+func (pq *productQuantizer) delete(id int) {
+	pq.codes.delete(id)
+}
+
+func (pq *productQuantizer) oversampling() int {
+	return 1
+}
+
+func (pq *productQuantizer) queryDistancer(query []float32) distanceToQuery {
+	query = pq.prepare(query)
+
+	// table[segment*centroids+centroid] is the partial distance between the
+	// segment of the query and the centroid
+	table := make([]float32, pq.segments*pq.centroids)
+	for segment := 0; segment < pq.segments; segment++ {
+		querySegment := pq.segment(query, segment)
+		for centroid, vector := range pq.codebook[segment] {
+			table[segment*pq.centroids+centroid] = pq.distancer.partial(querySegment, vector)
+		}
+	}
+
+	return func(id int) float32 {
+		code := pq.codes.get(id)
+		if code == nil {
+			return maxDistance
+		}
+
+		sum := pq.distancer.offset
+		for segment, centroid := range code {
+			sum += table[segment*pq.centroids+int(centroid)]
+		}
+
+		return sum
+	}
+}
+
+func (pq *productQuantizer) distanceBetween(a, b int) float32 {
+	codeA, codeB := pq.codes.get(a), pq.codes.get(b)
+	if codeA == nil || codeB == nil {
+		return maxDistance
+	}
+
+	sum := pq.distancer.offset
+	for segment := range codeA {
+		sum += pq.distancer.partial(pq.codebook[segment][codeA[segment]],
+			pq.codebook[segment][codeB[segment]])
+	}
+
+	return sum
+}
+
+// kmeans clusters points into k centroids by squared euclidean distance. The
+// centroids start out as random points, centroids which lose all of their
+// points are moved to a random point again.
+func kmeans(points [][]float32, k, iterations int, r *rand.Rand) [][]float32 {
+	dimensions := len(points[0])
+	centroids := make([][]float32, k)
+	for i, pos := range r.Perm(len(points))[:k] {
+		centroids[i] = append([]float32(nil), points[pos]...)
+	}
+
+	assignments := make([]int, len(points))
+	for i := range assignments {
+		assignments[i] = -1
+	}
+
+	for iteration := 0; iteration < iterations; iteration++ {
+		changed := false
+		for i, point := range points {
+			nearest := nearestCentroid(centroids, point)
+			if nearest != assignments[i] {
+				assignments[i] = nearest
+				changed = true
+			}
+		}
+
+		if !changed {
+			break
+		}
+
+		sums := make([][]float32, k)
+		counts := make([]int, k)
+		for i := range sums {
+			sums[i] = make([]float32, dimensions)
+		}
+
+		for i, point := range points {
+			counts[assignments[i]]++
+			for d, value := range point {
+				sums[assignments[i]][d] += value
+			}
+		}
+
+		for i := range centroids {
+			if counts[i] == 0 {
+				copy(centroids[i], points[r.Intn(len(points))])
+				continue
+			}
+
+			for d := range centroids[i] {
+				centroids[i][d] = sums[i][d] / float32(counts[i])
+			}
+		}
+	}
+
+	return centroids
+}
+
+func nearestCentroid(centroids [][]float32, vector []float32) int {
+	nearest := 0
+	nearestDist := maxDistance
+	for i, centroid := range centroids {
+		if dist := squaredL2Impl(centroid, vector); dist < nearestDist {
+			nearest = i
+			nearestDist = dist
+		}
+	}
+
+	return nearest
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestProductQuantizer(t *testing.T) {
+	m = newMonitoring()
+
+	r := rand.New(rand.NewSource(7))
+	vectors := randomVectors(r, 1000, 32)
+
+	t.Run("invalid segments", func(t *testing.T) {
+		for _, segments := range []int{0, 5, 64} {
+			if _, err := trainProductQuantizer(vectors, metricSquaredL2, segments, r); err == nil {
+				t.Errorf("expected %d segments to be rejected for 32 dimensions", segments)
+			}
+		}
+	})
+
+	for _, metric := range []distanceMetric{metricSquaredL2, metricCosine, metricDotProduct} {
+		t.Run(metric.String(), func(t *testing.T) {
+			distancer, err := newDistanceProvider(metric)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cfg := testConfig()
+			cfg.distancer = distancer
+			h := newTestHnsw(t, cfg, func(id int) []float32 { return vectors[id] })
+
+			// half of the graph is built before compression, half after
+			for i := 0; i < 500; i++ {
+				h.insert(&hnswVertex{id: i})
+			}
+
+			pq, err := trainProductQuantizer(h.sampleQueries(r, 500), metric, 8, r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h.compress(pq)
+
+			for i := 500; i < len(vectors); i++ {
+				h.insert(&hnswVertex{id: i})
+			}
+
+			if pq.codes.get(999) == nil {
+				t.Fatalf("expected nodes inserted after compression to be encoded")
+			}
+
+			report := h.evaluate(h.sampleQueries(r, 50), 10, []int{100})
+			if recall := report.Results[0].Recall; recall < 0.9 {
+				t.Errorf("expected recall of at least 0.9 after rescoring, got %f", recall)
+			}
+
+			// rescored distances are exact
+			res := h.knnSearchByVector(vectors[3], 1, 100, nil)
+			if len(res) != 1 || res[0].distance != h.distancer.distance(vectors[res[0].id], vectors[3]) {
+				t.Errorf("expected exact distances after rescoring, got %v", res)
+			}
+		})
+	}
+}
+
+func TestCodeStore(t *testing.T) {
+	s := newCodeStore(3)
+	s.set(codesChunkSize+5, []byte{1, 2, 3})
+
+	if code := s.get(codesChunkSize + 5); len(code) != 3 || code[2] != 3 {
+		t.Errorf("expected code [1 2 3], got %v", code)
+	}
+
+	if s.get(5) != nil || s.get(10*codesChunkSize) != nil {
+		t.Errorf("expected no code for ids which were never set")
+	}
+
+	s.delete(codesChunkSize + 5)
+	if s.get(codesChunkSize+5) != nil {
+		t.Errorf("expected code to be deleted")
+	}
+}
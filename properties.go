@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var propertiesBucket = []byte("Properties")
+
+type propertyKind uint8
+
+const (
+	propertyString propertyKind = iota
+	propertyNumber
+	propertyBool
+	propertyDate
+)
+
+func (k propertyKind) String() string {
+	switch k {
+	case propertyString:
+		return "string"
+	case propertyNumber:
+		return "number"
+	case propertyBool:
+		return "boolean"
+	case propertyDate:
+		return "date"
+	default:
+		return fmt.Sprintf("unknown kind %d", k)
+	}
+}
+
+// propertyValue is comparable, so that it can be used as a map key. Booleans
+// are stored as 0 or 1 in num, dates as unix nanoseconds in date.
+type propertyValue struct {
+	kind propertyKind
+	str  string
+	num  float64
+	date int64
+}
+
+// parsePropertyValue converts a decoded json value. JSON has no dates, so
+// strings in RFC 3339 format, such as "2020-06-01T12:00:00Z", are dates.
+func parsePropertyValue(in interface{}) (propertyValue, error) {
+	switch v := in.(type) {
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return propertyValue{kind: propertyDate, date: t.UnixNano()}, nil
+		}
+		return propertyValue{kind: propertyString, str: v}, nil
+	case float64:
+		return propertyValue{kind: propertyNumber, num: v}, nil
+	case bool:
+		if v {
+			return propertyValue{kind: propertyBool, num: 1}, nil
+		}
+		return propertyValue{kind: propertyBool}, nil
+	default:
+		return propertyValue{}, fmt.Errorf("unsupported property value %v of type %T, "+
+			"must be a string, number, boolean or date", in, in)
+	}
+}
+
+// value is the inverse of parsePropertyValue, dates are formatted in UTC
+func (v propertyValue) value() interface{} {
+	switch v.kind {
+	case propertyNumber:
+		return v.num
+	case propertyBool:
+		return v.num == 1
+	case propertyDate:
+		return time.Unix(0, v.date).UTC().Format(time.RFC3339Nano)
+	default:
+		return v.str
+	}
+}
+
+// compareValues orders by kind first, so that values of the same kind are
+// next to each other in a sorted index
+func compareValues(a, b propertyValue) int {
+	if a.kind != b.kind {
+		if a.kind < b.kind {
+			return -1
+		}
+		return 1
+	}
+
+	switch a.kind {
+	case propertyString:
+		return strings.Compare(a.str, b.str)
+	case propertyDate:
+		switch {
+		case a.date < b.date:
+			return -1
+		case a.date > b.date:
+			return 1
+		}
+		return 0
+	default:
+		switch {
+		case a.num < b.num:
+			return -1
+		case a.num > b.num:
+			return 1
+		}
+		return 0
+	}
+}
+
+// sortedEntry is a single value of a single object in a sorted index
+type sortedEntry struct {
+	value propertyValue
+	id    int
+}
+
+func (e sortedEntry) less(other sortedEntry) bool {
+	if c := compareValues(e.value, other.value); c != 0 {
+		return c < 0
+	}
+
+	return e.id < other.id
+}
+
+// propertyStore keeps the properties of every object in bolt. For filtering,
+// each property has an inverted index from value to objects for equality and
+// a sorted index for ranges. The indexes only live in memory, they are
+// rebuilt from bolt on startup.
+type propertyStore struct {
+	sync.RWMutex
+	objects  map[int]map[string]propertyValue
+	inverted map[string]map[propertyValue]map[int]struct{}
+	sorted   map[string][]sortedEntry
+
+	// nil keeps the properties in memory only
+	db *bolt.DB
+}
+
+// newPropertyStore loads the existing properties from db, a nil db results in
+// an empty in-memory store
+func newPropertyStore(db *bolt.DB) (*propertyStore, error) {
+	p := &propertyStore{
+		objects:  map[int]map[string]propertyValue{},
+		inverted: map[string]map[propertyValue]map[int]struct{}{},
+		sorted:   map[string][]sortedEntry{},
+		db:       db,
+	}
+	if db == nil {
+		return p, nil
+	}
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(propertiesBucket)
+		if err != nil {
+			return err
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			var raw map[string]interface{}
+			if err := json.Unmarshal(v, &raw); err != nil {
+				return err
+			}
+
+			id := int(binary.BigEndian.Uint32(k))
+			props, err := parseProperties(raw)
+			if err != nil {
+				return fmt.Errorf("object %d: %v", id, err)
+			}
+
+			// every id is stored once, so there is nothing to replace and the
+			// sorted indexes can be sorted once at the end
+			p.objects[id] = props
+			for name, value := range props {
+				p.addInverted(id, name, value)
+				p.sorted[name] = append(p.sorted[name], sortedEntry{value: value, id: id})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("load properties: %v", err)
+	}
+
+	for _, entries := range p.sorted {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].less(entries[j]) })
+	}
+
+	return p, nil
+}
+
+func parseProperties(raw map[string]interface{}) (map[string]propertyValue, error) {
+	props := make(map[string]propertyValue, len(raw))
+	for name, in := range raw {
+		if name == "" {
+			return nil, fmt.Errorf("property names must not be empty")
+		}
+
+		value, err := parsePropertyValue(in)
+		if err != nil {
+			return nil, fmt.Errorf("property %q: %v", name, err)
+		}
+		props[name] = value
+	}
+
+	return props, nil
+}
+
+// set replaces all properties of the object, an empty map removes them
+func (p *propertyStore) set(id int, raw map[string]interface{}) error {
+	props, err := parseProperties(raw)
+	if err != nil {
+		return err
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	if p.db != nil {
+		err := p.db.Update(func(tx *bolt.Tx) error {
+			key := make([]byte, 4)
+			binary.BigEndian.PutUint32(key, uint32(id))
+
+			if len(props) == 0 {
+				return tx.Bucket(propertiesBucket).Delete(key)
+			}
+
+			value, err := json.Marshal(raw)
+			if err != nil {
+				return err
+			}
+
+			return tx.Bucket(propertiesBucket).Put(key, value)
+		})
+		if err != nil {
+			return fmt.Errorf("store properties of %d: %v", id, err)
+		}
+	}
+
+	p.setInMemory(id, props)
+	return nil
+}
+
+// setInMemory must be called with p locked
+func (p *propertyStore) setInMemory(id int, props map[string]propertyValue) {
+	for name, value := range p.objects[id] {
+		delete(p.inverted[name][value], id)
+		if len(p.inverted[name][value]) == 0 {
+			delete(p.inverted[name], value)
+		}
+
+		entries := p.sorted[name]
+		entry := sortedEntry{value: value, id: id}
+		pos := sort.Search(len(entries), func(i int) bool { return !entries[i].less(entry) })
+		p.sorted[name] = append(entries[:pos], entries[pos+1:]...)
+	}
+
+	if len(props) == 0 {
+		delete(p.objects, id)
+		return
+	}
+
+	p.objects[id] = props
+	for name, value := range props {
+		p.addInverted(id, name, value)
+
+		entries := p.sorted[name]
+		entry := sortedEntry{value: value, id: id}
+		pos := sort.Search(len(entries), func(i int) bool { return !entries[i].less(entry) })
+		entries = append(entries, sortedEntry{})
+		copy(entries[pos+1:], entries[pos:])
+		entries[pos] = entry
+		p.sorted[name] = entries
+	}
+}
+
+func (p *propertyStore) addInverted(id int, name string, value propertyValue) {
+	if p.inverted[name] == nil {
+		p.inverted[name] = map[propertyValue]map[int]struct{}{}
+	}
+	if p.inverted[name][value] == nil {
+		p.inverted[name][value] = map[int]struct{}{}
+	}
+	p.inverted[name][value][id] = struct{}{}
+}
+
+// get returns the properties in their json form, nil if the object has none
+func (p *propertyStore) get(id int) map[string]interface{} {
+	p.RLock()
+	defer p.RUnlock()
+
+	props := p.objects[id]
+	if len(props) == 0 {
+		return nil
+	}
+
+	out := make(map[string]interface{}, len(props))
+	for name, value := range props {
+		out[name] = value.value()
+	}
+
+	return out
+}
+
+// equal adds every object whose property has exactly this value to out
+func (p *propertyStore) equal(name string, value propertyValue, out *bitmapAllowList) {
+	p.RLock()
+	defer p.RUnlock()
+
+	for id := range p.inverted[name][value] {
+		out.add(id)
+	}
+}
+
+// between adds every object whose property lies between the bounds to out. A
+// nil bound is open, the bounds must be of the same kind and only values of
+// that kind can match.
+func (p *propertyStore) between(name string, lower, upper *propertyValue,
+	includeLower, includeUpper bool, out *bitmapAllowList) {
+	kind := lower
+	if kind == nil {
+		kind = upper
+	}
+
+	p.RLock()
+	defer p.RUnlock()
+
+	entries := p.sorted[name]
+	start := sort.Search(len(entries), func(i int) bool {
+		if lower == nil {
+			return entries[i].value.kind >= kind.kind
+		}
+
+		c := compareValues(entries[i].value, *lower)
+		return c > 0 || (c == 0 && includeLower)
+	})
+
+	for _, entry := range entries[start:] {
+		if entry.value.kind != kind.kind {
+			break
+		}
+
+		if upper != nil {
+			c := compareValues(entry.value, *upper)
+			if c > 0 || (c == 0 && !includeUpper) {
+				break
+			}
+		}
+
+		out.add(entry.id)
+	}
+}
+
+// texts returns the values of the string properties, ordered by property name
+func (p *propertyStore) texts(id int) []string {
+	p.RLock()
+	defer p.RUnlock()
+
+	names := make([]string, 0, len(p.objects[id]))
+	for name, value := range p.objects[id] {
+		if value.kind == propertyString {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	out := make([]string, len(names))
+	for i, name := range names {
+		out[i] = p.objects[id][name].str
+	}
+
+	return out
+}
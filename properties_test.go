@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestPropertyStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "properties")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	open := func() (*bolt.DB, *propertyStore) {
+		db, err := bolt.Open(filepath.Join(dir, "bolt.db"), 0600, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p, err := newPropertyStore(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db, p
+	}
+
+	db, p := open()
+	for id, props := range []map[string]interface{}{
+		{"category": "news", "price": 12.5, "published": "2020-06-01T12:00:00Z"},
+		{"category": "sports", "price": 3.0, "premium": true},
+		{"category": "news", "price": 40.0},
+	} {
+		if err := p.set(id, props); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := p.set(3, map[string]interface{}{"tags": []interface{}{"a"}}); err == nil {
+		t.Errorf("expected lists to be rejected")
+	}
+
+	// replacing must remove the old values from the indexes
+	if err := p.set(2, map[string]interface{}{"category": "weather", "price": 40.0}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db, p = open()
+	defer db.Close()
+
+	expected := map[string]interface{}{
+		"category": "news", "price": 12.5, "published": "2020-06-01T12:00:00Z",
+	}
+	if props := p.get(0); !reflect.DeepEqual(props, expected) {
+		t.Errorf("expected %v after reopening, got %v", expected, props)
+	}
+
+	news := newBitmapAllowList()
+	p.equal("category", propertyValue{kind: propertyString, str: "news"}, news)
+	if news.len() != 1 || !news.contains(0) {
+		t.Errorf("expected only 0 to be news, got %v", news.bits)
+	}
+
+	lower := propertyValue{kind: propertyNumber, num: 12.5}
+	expensive := newBitmapAllowList()
+	p.between("price", &lower, nil, false, false, expensive)
+	if expensive.len() != 1 || !expensive.contains(2) {
+		t.Errorf("expected only 2 to cost more than 12.5, got %v", expensive.bits)
+	}
+
+	if err := p.set(0, map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if props := p.get(0); props != nil {
+		t.Errorf("expected properties to be removed, got %v", props)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+)
+
+// scalarQuantizer maps every dimension onto 256 evenly spaced values between
+// the minimum and maximum seen in a calibration sample, so every dimension
+// takes a single byte instead of four. Values outside of the calibrated range
+// are clamped. Contrary to product quantization, the calibration is a single
+// pass over the sample and the error per dimension is bounded by half a
+// step.
+type scalarQuantizer struct {
+	dimensions int
+	metric     distanceMetric
+	distancer  segmentDistancer
+
+	// per dimension, value = min + step*code
+	min  []float32
+	step []float32
+
+	codes *codeStore
+
+	// buffers for decoded vectors, so that distanceBetween doesn't allocate
+	buffers sync.Pool
+}
+
+func trainScalarQuantizer(sample [][]float32, metric distanceMetric) (*scalarQuantizer, error) {
+	if len(sample) == 0 {
+		return nil, fmt.Errorf("cannot calibrate scalar quantizer without a sample")
+	}
+
+	distancer, err := newSegmentDistancer(metric)
+	if err != nil {
+		return nil, err
+	}
+
+	dimensions := len(sample[0])
+	minimum := make([]float32, dimensions)
+	maximum := make([]float32, dimensions)
+	for d := range minimum {
+		minimum[d] = math.MaxFloat32
+		maximum[d] = -math.MaxFloat32
+	}
+
+	for i, vector := range sample {
+		if len(vector) != dimensions {
+			return nil, fmt.Errorf("sample vector %d has %d dimensions, expected %d",
+				i, len(vector), dimensions)
+		}
+
+		for d, value := range prepareForCompression(metric, vector) {
+			if value < minimum[d] {
+				minimum[d] = value
+			}
+			if value > maximum[d] {
+				maximum[d] = value
+			}
+		}
+	}
+
+	step := make([]float32, dimensions)
+	for d := range step {
+		step[d] = (maximum[d] - minimum[d]) / 255
+	}
+
+	return newScalarQuantizer(metric, distancer, minimum, step), nil
+}
+
+func newScalarQuantizer(metric distanceMetric, distancer segmentDistancer,
+	minimum, step []float32) *scalarQuantizer {
+	sq := &scalarQuantizer{
+		dimensions: len(minimum),
+		metric:     metric,
+		distancer:  distancer,
+		min:        minimum,
+		step:       step,
+		codes:      newCodeStore(len(minimum)),
+	}
+	sq.buffers.New = func() interface{} { return make([]float32, sq.dimensions) }
+
+	return sq
+}
+
+func (sq *scalarQuantizer) withoutCodes() *scalarQuantizer {
+	return newScalarQuantizer(sq.metric, sq.distancer, sq.min, sq.step)
+}
+
+func (sq *scalarQuantizer) encode(id int, vector []float32) {
+	if len(vector) != sq.dimensions {
+		panic(fmt.Sprintf("scalar quantizer was calibrated on %d dimensions, got %d",
+			sq.dimensions, len(vector)))
+	}
+
+	code := make([]byte, sq.dimensions)
+	for d, value := range prepareForCompression(sq.metric, vector) {
+		if sq.step[d] == 0 {
+			// constant in the sample, every value maps to the minimum
+			continue
+		}
+
+		q := math.Round(float64((value - sq.min[d]) / sq.step[d]))
+		code[d] = byte(math.Max(0, math.Min(255, q)))
+	}
+
+	sq.codes.set(id, code)
+}
+
+func (sq *scalarQuantizer) delete(id int) {
+	sq.codes.delete(id)
+}
+
+func (sq *scalarQuantizer) oversampling() int {
+	return 1
+}
+
+// decode writes the approximate vector for code into out
+func (sq *scalarQuantizer) decode(code []byte, out []float32) {
+	for d, q := range code {
+		out[d] = sq.min[d] + sq.step[d]*float32(q)
+	}
+}
+
+// queryDistancer decodes into a buffer which belongs to the distancer, this is
+// safe because a distancer is only used by a single search
+func (sq *scalarQuantizer) queryDistancer(query []float32) distanceToQuery {
+	query = prepareForCompression(sq.metric, query)
+	decoded := make([]float32, sq.dimensions)
+
+	return func(id int) float32 {
+		code := sq.codes.get(id)
+		if code == nil {
+			return maxDistance
+		}
+
+		sq.decode(code, decoded)
+		return sq.distancer.offset + sq.distancer.partial(query, decoded)
+	}
+}
+
+func (sq *scalarQuantizer) distanceBetween(a, b int) float32 {
+	codeA, codeB := sq.codes.get(a), sq.codes.get(b)
+	if codeA == nil || codeB == nil {
+		return maxDistance
+	}
+
+	decodedA := sq.buffers.Get().([]float32)
+	decodedB := sq.buffers.Get().([]float32)
+	defer sq.buffers.Put(decodedA)
+	defer sq.buffers.Put(decodedB)
+
+	sq.decode(codeA, decodedA)
+	sq.decode(codeB, decodedB)
+	return sq.distancer.offset + sq.distancer.partial(decodedA, decodedB)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestScalarQuantizer(t *testing.T) {
+	r := rand.New(rand.NewSource(7))
+	vectors := randomVectors(r, 1000, vectorDimensions)
+
+	t.Run("quantization error", func(t *testing.T) {
+		sq, err := trainScalarQuantizer(vectors, metricSquaredL2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sq.encode(0, vectors[0])
+		decoded := make([]float32, vectorDimensions)
+		sq.decode(sq.codes.get(0), decoded)
+		for d := range decoded {
+			diff := decoded[d] - vectors[0][d]
+			if diff > sq.step[d]/2+1e-6 || diff < -sq.step[d]/2-1e-6 {
+				t.Fatalf("dimension %d: error %f is more than half a step %f", d, diff, sq.step[d])
+			}
+		}
+
+		// outside of the calibrated range
+		outlier := make([]float32, vectorDimensions)
+		outlier[0] = 100
+		sq.encode(1, outlier)
+		if code := sq.codes.get(1); code[0] != 255 {
+			t.Errorf("expected value above the maximum to be clamped, got %d", code[0])
+		}
+	})
+
+	for _, metric := range []distanceMetric{metricSquaredL2, metricCosine} {
+		t.Run(metric.String(), func(t *testing.T) {
+			distancer, err := newDistanceProvider(metric)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cfg := testConfig()
+			cfg.maximumConnections = 16
+			cfg.distancer = distancer
+			h := buildTestGraph(t, vectors, cfg)
+
+			queries := h.sampleQueries(r, 50)
+			uncompressed := h.evaluate(queries, 10, []int{100}).Results[0].Recall
+
+			sq, err := trainScalarQuantizer(h.sampleQueries(r, 500), metric)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h.compress(sq)
+
+			compressed := h.evaluate(queries, 10, []int{100}).Results[0].Recall
+			if compressed < uncompressed-0.02 {
+				t.Errorf("expected nearly unchanged recall, got %f compressed and %f uncompressed",
+					compressed, uncompressed)
+			}
+		})
+	}
+}
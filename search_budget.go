@@ -0,0 +1,38 @@
+package main
+
+import "time"
+
+// searchBudgetCheckInterval is the number of candidates expanded between two
+// looks at the clock, time.Now is too expensive to call on every hop
+const searchBudgetCheckInterval = 16
+
+// searchBudget limits the time a single query can take. Once the deadline has
+// passed, the search stops expanding candidates and returns the best results
+// found so far. A nil budget never expires. A budget belongs to a single
+// query and must not be shared between goroutines.
+type searchBudget struct {
+	deadline time.Time
+	exceeded bool
+}
+
+func newSearchBudget(timeout time.Duration) *searchBudget {
+	return &searchBudget{deadline: time.Now().Add(timeout)}
+}
+
+func (b *searchBudget) expired() bool {
+	if b == nil {
+		return false
+	}
+
+	if !b.exceeded && time.Now().After(b.deadline) {
+		b.exceeded = true
+	}
+
+	return b.exceeded
+}
+
+// partial is true if a search was cut short, so its results may be worse than
+// without a budget
+func (b *searchBudget) partial() bool {
+	return b != nil && b.exceeded
+}
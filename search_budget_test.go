@@ -0,0 +1,41 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestSearchBudget(t *testing.T) {
+	vectors := randomVectors(rand.New(rand.NewSource(7)), 500, 16)
+	h := buildTestGraph(t, vectors, testConfig())
+
+	t.Run("without a budget", func(t *testing.T) {
+		var budget *searchBudget
+		res := h.knnSearchByVectorWithBudget(vectors[3], 10, 64, nil, budget)
+		if len(res) != 10 || budget.partial() {
+			t.Errorf("expected 10 complete results, got %d (partial: %t)", len(res), budget.partial())
+		}
+	})
+
+	t.Run("with a generous budget", func(t *testing.T) {
+		budget := newSearchBudget(time.Minute)
+		res := h.knnSearchByVectorWithBudget(vectors[3], 10, 64, nil, budget)
+		if len(res) != 10 || budget.partial() {
+			t.Errorf("expected 10 complete results, got %d (partial: %t)", len(res), budget.partial())
+		}
+	})
+
+	t.Run("with an exceeded budget", func(t *testing.T) {
+		budget := newSearchBudget(time.Nanosecond)
+		time.Sleep(time.Millisecond)
+		res := h.knnSearchByVectorWithBudget(vectors[3], 10, 64, nil, budget)
+		if !budget.partial() {
+			t.Errorf("expected search to be marked as partial")
+		}
+
+		if len(res) >= 10 {
+			t.Errorf("expected search to stop early, got %d results", len(res))
+		}
+	})
+}
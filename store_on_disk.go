@@ -63,6 +63,15 @@ func storeToBolt(index int64, vector []float32) error {
 			return err
 		}
 
+		// normalized once here instead of on every miss of the cache
+		if cache.normalize {
+			b := tx.Bucket([]byte("NormalizedVectors"))
+			err := b.Put([]byte(fmt.Sprintf("%d", index)), vectorToBytes(normalizeVector(vector)))
+			if err != nil {
+				return err
+			}
+		}
+
 		return nil
 	})
 
@@ -72,6 +81,18 @@ func storeToBolt(index int64, vector []float32) error {
 	return nil
 }
 
+// putVector replaces the vector of an existing object and makes sure no
+// stale copy is served from the cache afterwards
+func putVector(index int64, vector []float32) error {
+	err := storeToBolt(index, vector)
+	if err != nil {
+		return err
+	}
+
+	cache.delete(int(index))
+	return nil
+}
+
 func vectorToBytes(in []float32) []byte {
 
 	bytes := make([]byte, len(in)*4)
@@ -100,9 +121,12 @@ func vectorFromBytes(in []byte) ([]float32, error) {
 	return out, nil
 }
 
+// readVectorFromBolt is called on every miss of the vector cache, so it is
+// only timed with flagMonitorDistancing
 func readVectorFromBolt(i int64) ([]float32, error) {
-	before := time.Now()
-	defer m.addReadingDisk(before)
+	if flagMonitorDistancing {
+		defer m.addReadingDisk(time.Now())
+	}
 
 	var out []float32
 	var err error
@@ -116,6 +140,67 @@ func readVectorFromBolt(i int64) ([]float32, error) {
 	return out, err
 }
 
+// readNormalizedVectorFromBolt reads the unit-length copy which storeToBolt
+// keeps for cosine distance. Vectors stored without a copy are normalized on
+// the fly.
+func readNormalizedVectorFromBolt(i int64) ([]float32, error) {
+	if flagMonitorDistancing {
+		defer m.addReadingDisk(time.Now())
+	}
+
+	var out []float32
+	var err error
+	var found bool
+	db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte("NormalizedVectors")).Get([]byte(fmt.Sprintf("%d", i)))
+		if v == nil {
+			return nil
+		}
+
+		found = true
+		out, err = vectorFromBytes(v)
+		return nil
+	})
+
+	if found {
+		return out, err
+	}
+
+	out, err = readVectorFromBolt(i)
+	return normalizeVector(out), err
+}
+
+// storeMissingNormalizedVectors adds the normalized copies to a database
+// which was built before they were stored along with the vectors
+func storeMissingNormalizedVectors() error {
+	before := time.Now()
+	added := 0
+	err := db.Update(func(tx *bolt.Tx) error {
+		normalized := tx.Bucket([]byte("NormalizedVectors"))
+		return tx.Bucket([]byte("Vectors")).ForEach(func(k, v []byte) error {
+			if normalized.Get(k) != nil {
+				return nil
+			}
+
+			vector, err := vectorFromBytes(v)
+			if err != nil {
+				return fmt.Errorf("vector %s: %v", k, err)
+			}
+
+			added++
+			return normalized.Put(k, vectorToBytes(normalizeVector(vector)))
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("store normalized vectors: %v", err)
+	}
+
+	if added > 0 {
+		log.Printf("stored %d missing normalized vectors in %s", added, time.Since(before))
+	}
+	return nil
+}
+
 func readVectorFromFile(i int64) ([]float32, error) {
 	before := time.Now()
 	defer m.addReadingDisk(before)
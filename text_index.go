@@ -0,0 +1,179 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// BM25 parameters, k1 limits the effect of repeated terms and b the length
+// normalization. These are the common defaults.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// textIndex is an inverted index over the names and the string properties of
+// the objects, scored with BM25. All texts of an object form a single
+// document. The index only lives in memory, it is rebuilt on startup.
+type textIndex struct {
+	sync.RWMutex
+
+	// term frequency per term and object
+	postings map[string]map[int]int
+
+	// distinct terms per object, so that deletes don't scan all postings
+	terms map[int][]string
+
+	// number of terms per object
+	lengths     map[int]int
+	totalLength int
+}
+
+type textResult struct {
+	id    int
+	score float32
+}
+
+func newTextIndex() *textIndex {
+	return &textIndex{
+		postings: map[string]map[int]int{},
+		terms:    map[int][]string{},
+		lengths:  map[int]int{},
+	}
+}
+
+// newTextIndexFrom indexes the name and the string properties of every object
+// in index, the id mapping still knows deleted objects
+func newTextIndexFrom(ids *idMapping, properties *propertyStore, index vectorIndex) *textIndex {
+	t := newTextIndex()
+	for id := 0; id < ids.nextInternalID(); id++ {
+		if !index.contains(id) {
+			continue
+		}
+
+		name, err := ids.externalID(uint32(id))
+		if err != nil {
+			continue
+		}
+
+		t.index(id, append([]string{name}, properties.texts(id)...))
+	}
+
+	return t
+}
+
+// tokenize lowercases and splits on everything that is neither a letter nor a
+// digit, so a product code like "XB-400a" becomes "xb" and "400a"
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// index replaces the document of the object
+func (t *textIndex) index(id int, texts []string) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.deleteUnlocked(id)
+
+	length := 0
+	for _, text := range texts {
+		for _, term := range tokenize(text) {
+			if t.postings[term] == nil {
+				t.postings[term] = map[int]int{}
+			}
+			if t.postings[term][id] == 0 {
+				t.terms[id] = append(t.terms[id], term)
+			}
+			t.postings[term][id]++
+			length++
+		}
+	}
+
+	if length == 0 {
+		return
+	}
+
+	t.lengths[id] = length
+	t.totalLength += length
+}
+
+func (t *textIndex) delete(id int) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.deleteUnlocked(id)
+}
+
+func (t *textIndex) deleteUnlocked(id int) {
+	length, ok := t.lengths[id]
+	if !ok {
+		return
+	}
+
+	for _, term := range t.terms[id] {
+		delete(t.postings[term], id)
+		if len(t.postings[term]) == 0 {
+			delete(t.postings, term)
+		}
+	}
+
+	delete(t.terms, id)
+	delete(t.lengths, id)
+	t.totalLength -= length
+}
+
+// search returns the k best scoring objects which contain at least one of the
+// terms of the query. If allow is set, only allowed objects are returned.
+func (t *textIndex) search(query string, k int, allow allowList) []textResult {
+	t.RLock()
+	defer t.RUnlock()
+
+	if len(t.lengths) == 0 {
+		return nil
+	}
+
+	documents := float64(len(t.lengths))
+	averageLength := float64(t.totalLength) / documents
+
+	scores := map[int]float64{}
+	for _, term := range tokenize(query) {
+		frequencies := t.postings[term]
+		if len(frequencies) == 0 {
+			continue
+		}
+
+		df := float64(len(frequencies))
+		idf := math.Log(1 + (documents-df+0.5)/(df+0.5))
+		for id, tf := range frequencies {
+			if allow != nil && !allow.contains(id) {
+				continue
+			}
+
+			norm := 1 - bm25B + bm25B*float64(t.lengths[id])/averageLength
+			scores[id] += idf * float64(tf) * (bm25K1 + 1) / (float64(tf) + bm25K1*norm)
+		}
+	}
+
+	out := make([]textResult, 0, len(scores))
+	for id, score := range scores {
+		out = append(out, textResult{id: id, score: float32(score)})
+	}
+
+	sort.Slice(out, func(a, b int) bool {
+		if out[a].score != out[b].score {
+			return out[a].score > out[b].score
+		}
+		return out[a].id < out[b].id
+	})
+
+	if len(out) > k {
+		out = out[:k]
+	}
+
+	return out
+}
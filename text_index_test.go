@@ -0,0 +1,70 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tokens := tokenize("Waterproof jacket, XB-400a (Größe L)")
+	expected := []string{"waterproof", "jacket", "xb", "400a", "größe", "l"}
+	if !reflect.DeepEqual(tokens, expected) {
+		t.Errorf("expected %v, got %v", expected, tokens)
+	}
+}
+
+func TestTextIndex(t *testing.T) {
+	text := newTextIndex()
+	text.index(0, []string{"red jacket", "waterproof outdoor jacket"})
+	text.index(1, []string{"blue jacket"})
+	text.index(2, []string{"XB-400a", "red shoes for running on long and winding roads"})
+	text.index(3, []string{"green shoes"})
+
+	t.Run("ranking", func(t *testing.T) {
+		res := text.search("jacket", 10, nil)
+		if len(res) != 2 || res[0].id != 0 || res[1].id != 1 {
+			t.Fatalf("expected the repeated term to rank 0 above 1, got %v", res)
+		}
+
+		// "xb" and "400a" are rare, so they outweigh the common "red"
+		res = text.search("red xb-400a", 10, nil)
+		if len(res) != 2 || res[0].id != 2 || res[1].id != 0 {
+			t.Fatalf("expected the product code to rank 2 first, got %v", res)
+		}
+
+		if res := text.search("red", 1, nil); len(res) != 1 || res[0].id != 0 {
+			t.Errorf("expected the shorter document to win at k=1, got %v", res)
+		}
+
+		if res := text.search("purple", 10, nil); len(res) != 0 {
+			t.Errorf("expected no results for an unknown term, got %v", res)
+		}
+	})
+
+	t.Run("allow list", func(t *testing.T) {
+		res := text.search("jacket", 10, newIDSetAllowList(1))
+		if len(res) != 1 || res[0].id != 1 {
+			t.Errorf("expected only 1, got %v", res)
+		}
+	})
+
+	t.Run("reindex and delete", func(t *testing.T) {
+		text.index(1, []string{"blue trousers"})
+		if res := text.search("jacket", 10, nil); len(res) != 1 || res[0].id != 0 {
+			t.Errorf("expected the old text of 1 to be gone, got %v", res)
+		}
+
+		text.delete(0)
+		if res := text.search("jacket", 10, nil); len(res) != 0 {
+			t.Errorf("expected no results after the delete, got %v", res)
+		}
+
+		if _, ok := text.postings["jacket"]; ok {
+			t.Errorf("expected empty postings to be removed")
+		}
+
+		if text.totalLength != 2+11+2 {
+			t.Errorf("expected a total length of 15, got %d", text.totalLength)
+		}
+	})
+}
@@ -108,6 +108,11 @@ type syncCache struct {
 	cache   sync.Map
 	count   int32
 	maxSize int
+
+	// serve vectors with unit length, so that cosine distance is a plain dot
+	// product. They are normalized when they are stored, next to the
+	// originals. Must be set before the first vector is stored or read.
+	normalize bool
 }
 
 func newCache() *syncCache {
@@ -119,14 +124,21 @@ func newCache() *syncCache {
 
 }
 
+// get is called for every uncompressed distance, so like the distances it is
+// only timed with flagMonitorDistancing
 func (c *syncCache) get(i int) []float32 {
 	before := time.Now()
 	vec, ok := c.cache.Load(i)
-	m.addCacheReadLocking(before)
+	if flagMonitorDistancing {
+		m.addCacheReadLocking(before)
+	}
 	if !ok {
-		before := time.Now()
-		vec, err := readVectorFromBolt(int64(i))
-		m.addReadingDisk(before)
+		read := readVectorFromBolt
+		if c.normalize {
+			read = readNormalizedVectorFromBolt
+		}
+
+		vec, err := read(int64(i))
 		if err != nil {
 			fmt.Printf("bolt read error: %v\n", err)
 		}
@@ -134,8 +146,9 @@ func (c *syncCache) get(i int) []float32 {
 		if c.count >= int32(c.maxSize) {
 			before := time.Now()
 			c.cache.Range(func(key, value interface{}) bool {
-				c.cache.Delete(key)
-				atomic.AddInt32(&c.count, -1)
+				if _, loaded := c.cache.LoadAndDelete(key); loaded {
+					atomic.AddInt32(&c.count, -1)
+				}
 
 				return true
 			})
@@ -144,10 +157,22 @@ func (c *syncCache) get(i int) []float32 {
 
 		before = time.Now()
 		c.cache.Store(i, vec)
-		m.addCacheLocking(before)
+		if flagMonitorDistancing {
+			m.addCacheLocking(before)
+		}
 		atomic.AddInt32(&c.count, 1)
 		return vec
 	}
 
 	return vec.([]float32)
 }
+
+// delete removes a single vector from the cache, e.g. because it was updated
+// on disk
+func (c *syncCache) delete(i int) {
+	// only the call which actually removed the entry may decrement, so that
+	// concurrent deletes of the same id are counted once
+	if _, loaded := c.cache.LoadAndDelete(i); loaded {
+		atomic.AddInt32(&c.count, -1)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestSyncCacheDelete(t *testing.T) {
+	c := newCache()
+	c.cache.Store(7, []float32{1, 2, 3})
+	c.count = 1
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.delete(7)
+		}()
+	}
+	wg.Wait()
+
+	if c.count != 0 {
+		t.Errorf("expected concurrent deletes of the same id to count once, got count %d", c.count)
+	}
+
+	if _, ok := c.cache.Load(7); ok {
+		t.Errorf("expected the vector to be removed")
+	}
+}
+
+func TestSyncCacheNormalize(t *testing.T) {
+	m = newMonitoring()
+
+	dir, err := ioutil.TempDir("", "vector_cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	boltdb, err := bolt.Open(filepath.Join(dir, "bolt.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer boltdb.Close()
+	if err := createVectorBuckets(boltdb); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(previousDB *bolt.DB, previousCache *syncCache) {
+		db, cache = previousDB, previousCache
+	}(db, cache)
+	db, cache = boltdb, newCache()
+
+	// stored before normalizing was enabled, like in an older database
+	legacy := []float32{0, 3, 4}
+	if err := storeToBolt(1, legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	cache.normalize = true
+	original := []float32{3, 0, 4}
+	if err := storeToBolt(2, original); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := cache.get(1); !reflect.DeepEqual(got, normalizeVector(legacy)) {
+		t.Errorf("expected a vector without a stored copy to be normalized, got %v", got)
+	}
+
+	if err := storeMissingNormalizedVectors(); err != nil {
+		t.Fatal(err)
+	}
+
+	for id, vector := range map[int][]float32{1: legacy, 2: original} {
+		cache.delete(id)
+		if got := cache.get(id); !reflect.DeepEqual(got, normalizeVector(vector)) {
+			t.Errorf("expected the cache to serve %v for %d, got %v", normalizeVector(vector), id, got)
+		}
+
+		// the original is kept for includeVector
+		if got, err := readVectorFromBolt(int64(id)); err != nil || !reflect.DeepEqual(got, vector) {
+			t.Errorf("expected the original %v for %d, got %v (%v)", vector, id, got, err)
+		}
+	}
+
+	db.View(func(tx *bolt.Tx) error {
+		if stored := tx.Bucket([]byte("NormalizedVectors")).Stats().KeyN; stored != 2 {
+			t.Errorf("expected 2 normalized copies, got %d", stored)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,57 @@
+package main
+
+// vectorIndex is what the http handlers need from an index. It is implemented
+// by the hnsw graph and by the flat index, which is cheaper for small
+// collections and promotes itself to an hnsw graph as it grows.
+type vectorIndex interface {
+	// add indexes the vector that is stored for id. If id is already part of
+	// the index, it is updated instead.
+	add(id int)
+
+	// update re-indexes id after its stored vector has changed
+	update(id int) error
+
+	// delete removes id from all future search results
+	delete(id int) error
+
+	// contains is false for ids which were never added or have been deleted
+	contains(id int) bool
+
+	knnSearchByVectorWithBudget(queryVector []float32, k int, ef int, allow allowList,
+		budget *searchBudget) []searchResult
+
+	rangeSearchByVector(queryVector []float32, maxDistance float32, ef int, maxEf int,
+		allow allowList, budget *searchBudget) ([]searchResult, bool)
+
+	// vectorOf returns the vector as it is held by the index, which might be a
+	// normalized copy
+	vectorOf(id int) []float32
+
+	metric() distanceMetric
+}
+
+func (h *hnsw) add(id int) {
+	h.insert(&hnswVertex{id: id})
+}
+
+func (h *hnsw) contains(id int) bool {
+	return h.isAllowedResult(id, nil)
+}
+
+func (h *hnsw) vectorOf(id int) []float32 {
+	return h.vectorForID(id)
+}
+
+func (h *hnsw) metric() distanceMetric {
+	return h.distancer.metric()
+}
+
+// prepareQueryFor brings an arbitrary query vector into the same form as the
+// vectors of an index using distancer
+func prepareQueryFor(distancer distanceProvider, queryVector []float32) []float32 {
+	if _, ok := distancer.(normalizedCosineDistancer); ok {
+		return normalizeVector(queryVector)
+	}
+
+	return queryVector
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// where the verify command loads the index from
+const (
+	// same as verifySourceCommitLog, which is what the server loads
+	verifySourceAuto = "auto"
+
+	// only the index file, without the changes since it was written
+	verifySourceIndex = "index"
+
+	// the index file if present, with the changes from the commit log
+	verifySourceCommitLog = "commitlog"
+)
+
+type verifyReport struct {
+	Source     string           `json:"source"`
+	Nodes      int              `json:"nodes"`
+	Violations []graphViolation `json:"violations"`
+	Error      string           `json:"error,omitempty"`
+}
+
+// runVerify loads the index, checks its invariants and writes the report as
+// JSON to w. It returns the exit code: 0 if the index is sound, 1 if there
+// are violations and 2 if the index could not be loaded.
+func runVerify(source string, w io.Writer) int {
+	if source == verifySourceAuto {
+		source = verifySourceCommitLog
+	}
+
+	report := verifyReport{Source: source, Violations: []graphViolation{}}
+	g, err := loadForVerify(source)
+	if err != nil {
+		report.Error = err.Error()
+		json.NewEncoder(w).Encode(report)
+		return 2
+	}
+
+	report.Nodes = g.nodes.len()
+	report.Violations = g.verify()
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+
+	if len(report.Violations) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func loadForVerify(source string) (*hnsw, error) {
+	switch source {
+	case verifySourceIndex:
+		bytes, err := ioutil.ReadFile(indexPath)
+		if err != nil {
+			return nil, fmt.Errorf("read index: %v", err)
+		}
+
+		g := &hnsw{}
+		if err := UnmarshalGzip(bytes, g); err != nil {
+			return nil, fmt.Errorf("unmarshal index: %v", err)
+		}
+		return g, nil
+
+	case verifySourceCommitLog:
+		// without an index file, the commit log holds the whole graph, but not
+		// its configuration, so it has to match the one the index was built
+		// with. Vectors are not needed. Only the primary is verified.
+		g := newHnswWithCommitLogger("verify", indexConfig(nil), nil, nil)
+		logPath := commitLogPathFor("primary")
+		if fileExists(indexPath) {
+			bytes, err := ioutil.ReadFile(indexPath)
+			if err != nil {
+				return nil, fmt.Errorf("read index: %v", err)
+			}
+
+			if err := UnmarshalGzip(bytes, g); err != nil {
+				return nil, fmt.Errorf("unmarshal index: %v", err)
+			}
+
+			if !fileExists(logPath) {
+				return g, nil
+			}
+		}
+
+		if err := replayCommitLogFile(logPath, g); err != nil {
+			return nil, err
+		}
+		return g, nil
+
+	default:
+		return nil, fmt.Errorf("unknown source %q", source)
+	}
+}
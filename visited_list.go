@@ -0,0 +1,91 @@
+package main
+
+import (
+	"math"
+	"sync"
+)
+
+// visitedList keeps track of the nodes visited during a single search. A node
+// counts as visited if its mark matches the current generation, so resetting
+// the list for the next search is O(1) instead of allocating a new set.
+type visitedList struct {
+	generation uint16
+	marks      []uint16
+}
+
+func newVisitedList(size int) *visitedList {
+	return &visitedList{generation: 1, marks: make([]uint16, size)}
+}
+
+func (v *visitedList) visit(id uint32) {
+	if int(id) >= len(v.marks) {
+		// the graph has grown since the list was created
+		grown := make([]uint16, max(int(id)+1, 2*len(v.marks)))
+		copy(grown, v.marks)
+		v.marks = grown
+	}
+
+	v.marks[id] = v.generation
+}
+
+func (v *visitedList) visited(id uint32) bool {
+	return int(id) < len(v.marks) && v.marks[id] == v.generation
+}
+
+func (v *visitedList) reset() {
+	if v.generation == math.MaxUint16 {
+		// marks from old generations could be mistaken for the new one once the
+		// counter wraps around, so this is the only time we need to clear
+		for i := range v.marks {
+			v.marks[i] = 0
+		}
+		v.generation = 0
+	}
+
+	v.generation++
+}
+
+// visitedListPool hands out visited lists to concurrent searches and inserts,
+// so that they are reused instead of creating garbage on every searchLayer
+// call
+type visitedListPool struct {
+	sync.Mutex
+	lists []*visitedList
+}
+
+func newVisitedListPool() *visitedListPool {
+	return &visitedListPool{}
+}
+
+// borrow returns a reset list, new lists are created with room for size
+// nodes, existing ones grow on demand
+func (p *visitedListPool) borrow(size int) *visitedList {
+	p.Lock()
+	if len(p.lists) == 0 {
+		p.Unlock()
+		return newVisitedList(size)
+	}
+
+	l := p.lists[len(p.lists)-1]
+	p.lists = p.lists[:len(p.lists)-1]
+	p.Unlock()
+
+	return l
+}
+
+// giveBack makes the list available to the next search, it must not be used
+// by the caller anymore
+func (p *visitedListPool) giveBack(l *visitedList) {
+	l.reset()
+
+	p.Lock()
+	p.lists = append(p.lists, l)
+	p.Unlock()
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestVisitedList(t *testing.T) {
+	l := newVisitedList(10)
+	l.visit(3)
+	l.visit(25) // larger than the initial size
+
+	if !l.visited(3) || !l.visited(25) {
+		t.Errorf("expected 3 and 25 to be visited")
+	}
+
+	if l.visited(4) || l.visited(1000) {
+		t.Errorf("expected 4 and 1000 not to be visited")
+	}
+
+	l.reset()
+	if l.visited(3) || l.visited(25) {
+		t.Errorf("expected list to be empty after reset")
+	}
+
+	t.Run("generation wrapping around", func(t *testing.T) {
+		l := newVisitedList(10)
+		l.visit(5)
+		for i := 0; i < math.MaxUint16; i++ {
+			l.reset()
+		}
+
+		if l.visited(5) {
+			t.Errorf("old mark must not be mistaken for the current generation")
+		}
+	})
+
+	t.Run("pool hands out reset lists", func(t *testing.T) {
+		p := newVisitedListPool()
+		l := p.borrow(10)
+		l.visit(7)
+		p.giveBack(l)
+
+		if p.borrow(10).visited(7) {
+			t.Errorf("expected a reset list")
+		}
+	})
+}